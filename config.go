@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// Options that are written to a new config file, with their defaults
+var configDefaults = []string{"theme", "font", "font-size", "width", "height", "debounce"}
+
+func configPath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "mdvy", "config.json"), nil
+}
+
+// Loads the config file, which maps flag names to values. A config file with
+// the defaults is created if there is none.
+func LoadConfig() (map[string]any, error) {
+	p, err := configPath()
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(p)
+	if errors.Is(err, fs.ErrNotExist) {
+		if err := createConfig(p, flag.CommandLine); err != nil {
+			log.Printf("error creating config file: %v", err)
+		}
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var config map[string]any
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("%s: %w", p, err)
+	}
+	return config, nil
+}
+
+// The config gets the built-in defaults, not the values of the flags, which
+// may already have been set on the command line.
+func createConfig(p string, flags *flag.FlagSet) error {
+	config := map[string]any{}
+	for _, name := range configDefaults {
+		var v any = flags.Lookup(name).DefValue
+		if n, err := strconv.Atoi(flags.Lookup(name).DefValue); err == nil {
+			v = n
+		}
+		config[name] = v
+	}
+	data, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(p, append(data, '\n'), 0o644)
+}
+
+// Sets the flags from the config, except for the ones in explicit
+func applyConfig(flags *flag.FlagSet, config map[string]any, explicit map[string]bool) error {
+	for name, value := range config {
+		if flags.Lookup(name) == nil {
+			return fmt.Errorf("unknown option in config: %s", name)
+		}
+		if explicit[name] {
+			continue
+		}
+		s := fmt.Sprint(value)
+		// JSON numbers are float64, which Sprint formats with an exponent
+		// (1e+06)
+		if f, ok := value.(float64); ok {
+			s = strconv.FormatFloat(f, 'f', -1, 64)
+		}
+		if err := flags.Set(name, s); err != nil {
+			return fmt.Errorf("invalid value for %s in config: %w", name, err)
+		}
+	}
+	return nil
+}
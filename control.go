@@ -0,0 +1,36 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+// Control channel for editor plugins, served over HTTP with -control.
+//
+//	POST /scroll?line=N
+//
+// scrolls the preview to the block at (or closest before) source line N,
+// counting from 1.
+func (v *View) ListenControl(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/scroll", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		line, err := strconv.Atoi(r.URL.Query().Get("line"))
+		if err != nil || line < 1 {
+			http.Error(w, "invalid line", http.StatusBadRequest)
+			return
+		}
+		v.wv.Dispatch(func() {
+			v.wv.Eval(fmt.Sprintf(`scrollToLine(%d)`, line))
+		})
+	})
+	infof("listening for control requests on %s", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.Printf("control error: %v", err)
+	}
+}
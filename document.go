@@ -0,0 +1,439 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/remko/mdvy/render"
+)
+
+// Source name for reading from standard input
+const stdinSource = "-"
+
+// A source file that is converted to HTML, and optionally watched for changes.
+type Document struct {
+	source   string
+	input    []byte // Contents of stdin, when source is stdinSource
+	title    string
+	style    string // User stylesheet, if any
+	index    bool   // Source is a directory, shown as an index of its documents
+	encoding string
+	timeout  time.Duration // Maximum render time, or 0 for none
+	conv     *render.Converter
+	fsw      *fsnotify.Watcher
+	dirs     []string // Watched directories
+	missing  []string // Directories in dirs that couldn't be watched yet
+	debounce *Debouncer
+
+	// Serializes the use of conv, which keeps the results of the last
+	// conversion
+	convMu sync.Mutex
+	// Converts the source, like conv.Convert (which tests replace)
+	convert func(io.Reader, io.Writer) error
+
+	// Results of the last render. The lock is never held during a
+	// conversion, so the UI doesn't wait for one.
+	mu     sync.Mutex
+	images map[string]bool
+	words  int
+}
+
+// The format is detected from the source if opts.Format is empty.
+func NewDocument(source string, opts Options) (*Document, error) {
+	var input []byte
+	title := source
+	if source == stdinSource {
+		var err error
+		input, err = io.ReadAll(os.Stdin)
+		if err != nil {
+			return nil, err
+		}
+		title = "stdin"
+	}
+
+	var index bool
+	if source != stdinSource {
+		if info, err := os.Stat(source); err == nil && info.IsDir() {
+			index = true
+		}
+	}
+
+	format := opts.Format
+	if format == "" && !index {
+		format = render.FormatFromExtension(source)
+	}
+	if format == "" {
+		data := input
+		if source != stdinSource {
+			data, _ = os.ReadFile(source)
+		}
+		data, _ = render.Decode(data, opts.Encoding)
+		format = render.SniffFormat(data)
+	}
+
+	var style string
+	if opts.CSS != "" {
+		style = filepath.Clean(opts.CSS)
+	}
+
+	var fsw *fsnotify.Watcher
+	var dirs, missing []string
+	if !opts.NoWatch {
+		if index {
+			dirs = append(dirs, filepath.Clean(source))
+		} else if source != stdinSource {
+			dirs = append(dirs, filepath.Dir(source))
+		}
+		if style != "" {
+			dirs = append(dirs, filepath.Dir(style))
+		}
+		if len(dirs) > 0 {
+			var err error
+			fsw, err = fsnotify.NewWatcher()
+			if err != nil {
+				return nil, err
+			}
+			for _, dir := range dirs {
+				if err := fsw.Add(dir); err != nil {
+					// A missing stylesheet falls back to the default style,
+					// and is picked up once it is created
+					if style != "" && dir == filepath.Dir(style) {
+						log.Printf("not watching %s: %v", dir, err)
+						missing = append(missing, dir)
+						continue
+					}
+					fsw.Close()
+					return nil, err
+				}
+			}
+		}
+	}
+
+	conv := render.NewConverter(format, opts.Options)
+	return &Document{
+		source:   source,
+		input:    input,
+		title:    title,
+		style:    style,
+		index:    index,
+		encoding: opts.Encoding,
+		timeout:  opts.RenderTimeout,
+		conv:     conv,
+		convert:  conv.Convert,
+		fsw:      fsw,
+		dirs:     dirs,
+		missing:  missing,
+		debounce: NewDebouncer(opts.Debounce),
+	}, nil
+}
+
+// Stops watching the document, and drops a pending change notification.
+func (d *Document) Close() {
+	d.debounce.Cancel()
+	if d.fsw != nil {
+		d.fsw.Close()
+	}
+}
+
+// Returns the HTML content and the title of the document, which falls back to
+// the file name.
+// Renders are serialized, and a render that is canceled while waiting for a
+// previous one (or while reading the file) is abandoned. The conversion
+// itself can't be interrupted, so a render that is canceled or times out
+// during it finishes in the background, before the next one starts.
+func (d *Document) Render(ctx context.Context) (string, string, error) {
+	type result struct {
+		content string
+		title   string
+		err     error
+	}
+	done := make(chan result, 1)
+	go func() {
+		d.convMu.Lock()
+		defer d.convMu.Unlock()
+		if err := ctx.Err(); err != nil {
+			done <- result{err: err}
+			return
+		}
+		start := time.Now()
+		content, title, err := d.render(ctx)
+		if elapsed := time.Since(start); elapsed > slowRender {
+			infof("slow render of %s: %v", d.title, elapsed)
+		}
+		done <- result{content, title, err}
+	}()
+	var timeout <-chan time.Time
+	if d.timeout > 0 {
+		timer := time.NewTimer(d.timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case r := <-done:
+		return r.content, r.title, r.err
+	case <-ctx.Done():
+		return "", "", ctx.Err()
+	case <-timeout:
+		return "", "", fmt.Errorf("rendering took longer than %v", d.timeout)
+	}
+}
+
+// Renders with convMu held
+func (d *Document) render(ctx context.Context) (string, string, error) {
+	if d.index {
+		content, err := renderIndex(d.source)
+		return content, filepath.Base(d.title), err
+	}
+
+	input := d.input
+	if d.source != stdinSource {
+		var err error
+		if input, err = os.ReadFile(d.source); err != nil {
+			return "", "", err
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return "", "", err
+	}
+	var content bytes.Buffer
+	if err := d.convert(bytes.NewReader(input), &content); err != nil {
+		return "", "", err
+	}
+	d.mu.Lock()
+	d.setImages(d.conv.Images())
+	d.words = d.conv.Words()
+	d.mu.Unlock()
+
+	title := d.conv.Title()
+	if title == "" {
+		title = filepath.Base(d.title)
+	}
+	return content.String(), title, nil
+}
+
+// Returns the contents of the user stylesheet. A missing stylesheet falls
+// back to the built-in style only.
+func (d *Document) Style() string {
+	if d.style == "" {
+		return ""
+	}
+	data, err := os.ReadFile(d.style)
+	if err != nil {
+		log.Printf("error reading stylesheet: %v", err)
+		return ""
+	}
+	return string(data)
+}
+
+// Returns the (decoded) source text of the document
+func (d *Document) Source() (string, error) {
+	if d.index {
+		return "", errors.New("directories have no source")
+	}
+	input := d.input
+	if d.source != stdinSource {
+		var err error
+		if input, err = os.ReadFile(d.source); err != nil {
+			return "", err
+		}
+	}
+	input, err := render.Decode(input, d.encoding)
+	return string(input), err
+}
+
+// The source as shown in the status bar
+func (d *Document) Path() string {
+	if d.source == stdinSource {
+		return "stdin"
+	}
+	if path, err := filepath.Abs(d.source); err == nil {
+		return path
+	}
+	return d.source
+}
+
+// Returns the number of words of the last render
+func (d *Document) Words() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.words
+}
+
+func (d *Document) SetTask(index int, checked bool) error {
+	if d.source == stdinSource {
+		return errors.New("task lists can only be edited in markdown files")
+	}
+	d.convMu.Lock()
+	defer d.convMu.Unlock()
+	return d.conv.SetTask(d.source, index, checked)
+}
+
+// Returns the directory that relative links are resolved against
+func (d *Document) dir() string {
+	if d.index {
+		return d.source
+	}
+	return filepath.Dir(d.source)
+}
+
+// Whether name is a document listed in the index
+func (d *Document) inIndex(name string) bool {
+	return d.index && filepath.Dir(name) == d.source && render.FormatFromExtension(name) != ""
+}
+
+// Renders a list of links to the documents in dir
+func renderIndex(dir string) (string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return "", err
+	}
+	var content strings.Builder
+	fmt.Fprintf(&content, "<h1>%s</h1>\n<ul class=\"index\">\n", html.EscapeString(filepath.Base(dir)))
+	for _, e := range entries {
+		if e.IsDir() || render.FormatFromExtension(e.Name()) == "" {
+			continue
+		}
+		href := (&url.URL{Path: e.Name()}).String()
+		fmt.Fprintf(&content, "<li><a href=\"%s\">%s</a></li>\n", html.EscapeString(href), html.EscapeString(e.Name()))
+	}
+	content.WriteString("</ul>\n")
+	return content.String(), nil
+}
+
+// Keeps track of the local images of the document, which are the only files
+// the page can load. Changes to the ones next to the source trigger a
+// re-render as well. Called with mu held.
+func (d *Document) setImages(dests []string) {
+	images := map[string]bool{}
+	for _, dest := range dests {
+		if p, ok := d.localPath(dest); ok {
+			images[p] = true
+		}
+	}
+	d.images = images
+}
+
+// Returns the file a relative or absolute URL without scheme refers to
+func (d *Document) localPath(dest string) (string, bool) {
+	u, err := url.Parse(dest)
+	if err != nil || u.Scheme != "" || u.Host != "" || u.Path == "" {
+		return "", false
+	}
+	p := filepath.FromSlash(u.Path)
+	if !filepath.IsAbs(p) {
+		p = filepath.Join(filepath.Dir(d.source), p)
+	}
+	return filepath.Clean(p), true
+}
+
+// Returns a local image of the document as a data URL. The page is not
+// loaded from a file, so it can't load local files itself.
+func (d *Document) ImageData(src string) (string, error) {
+	p, ok := d.localPath(src)
+	if !ok || !d.isImage(p) {
+		return "", fmt.Errorf("not an image of the document: %s", src)
+	}
+	data, err := os.ReadFile(p)
+	if err != nil {
+		return "", err
+	}
+	typ := mime.TypeByExtension(filepath.Ext(p))
+	if typ == "" {
+		typ = http.DetectContentType(data)
+	}
+	return "data:" + typ + ";base64," + base64.StdEncoding.EncodeToString(data), nil
+}
+
+func (d *Document) isImage(p string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.images[p]
+}
+
+// Renders that take longer than this are logged
+const slowRender = time.Second
+
+// Interval for trying to watch a directory again after losing its watch
+const watchRetryInterval = time.Second
+
+// Calls onChange (debounced) whenever the document changes, until the
+// document is closed.
+func (d *Document) Watch(onChange func()) {
+	if d.fsw == nil {
+		return
+	}
+	// Directories whose watch was lost, and are watched again once they
+	// (or their replacements) exist
+	lost := map[string]bool{}
+	for _, dir := range d.missing {
+		lost[dir] = true
+	}
+	var retry <-chan time.Time
+	rewatch := func() {
+		for dir := range lost {
+			if err := d.fsw.Add(dir); err != nil {
+				debugf("error watching %s: %v", dir, err)
+				continue
+			}
+			infof("watching %s again", dir)
+			delete(lost, dir)
+			// Changes while it wasn't watched were missed
+			d.debounce.Add(onChange)
+		}
+		retry = nil
+		if len(lost) > 0 {
+			retry = time.After(watchRetryInterval)
+		}
+	}
+	if len(lost) > 0 {
+		retry = time.After(watchRetryInterval)
+	}
+	for {
+		select {
+		case event, ok := <-d.fsw.Events:
+			if !ok {
+				return
+			}
+			debugf("event: %v", event)
+			name := filepath.Clean(event.Name)
+			if slices.Contains(d.dirs, name) && (event.Has(fsnotify.Remove) || event.Has(fsnotify.Rename)) {
+				// The directory itself was moved or replaced, which drops the
+				// watch (or leaves it on the moved directory)
+				infof("lost the watch on %s", name)
+				d.fsw.Remove(name)
+				lost[name] = true
+				rewatch()
+			} else if (name == d.source || name == d.style || d.isImage(name) || d.inIndex(name)) && event.Op&^fsnotify.Chmod != 0 {
+				// Atomic saves remove or rename the file before a new one is
+				// created or renamed into place, so render on any change.
+				// The debounce makes the render see the new file.
+				d.debounce.Add(onChange)
+			}
+
+		case err, ok := <-d.fsw.Errors:
+			if !ok {
+				return
+			}
+			log.Println("watcher error:", err)
+
+		case <-retry:
+			rewatch()
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Waits for a change notification, and drops any that follow it
+func waitForChange(t *testing.T, changes chan struct{}, what string) {
+	t.Helper()
+	select {
+	case <-changes:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no change after %s", what)
+	}
+	for {
+		select {
+		case <-changes:
+		case <-time.After(100 * time.Millisecond):
+			return
+		}
+	}
+}
+
+func TestWatchLost(t *testing.T) {
+	tests := []struct {
+		name    string
+		replace func(dir string) error
+	}{
+		{"remove", os.RemoveAll},
+		{"rename", func(dir string) error { return os.Rename(dir, dir+".old") }},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := filepath.Join(t.TempDir(), "doc")
+			source := filepath.Join(dir, "doc.md")
+			if err := os.Mkdir(dir, 0o755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(source, []byte("a\n"), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			d, err := NewDocument(source, Options{Debounce: 10 * time.Millisecond})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer d.Close()
+			changes := make(chan struct{}, 10)
+			go d.Watch(func() { changes <- struct{}{} })
+
+			if err := os.WriteFile(source, []byte("b\n"), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			waitForChange(t, changes, "writing")
+
+			if err := test.replace(dir); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Mkdir(dir, 0o755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(source, []byte("c\n"), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			waitForChange(t, changes, "replacing the directory")
+
+			// The new directory is watched
+			if err := os.WriteFile(source, []byte("d\n"), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			waitForChange(t, changes, "writing in the new directory")
+		})
+	}
+}
+
+// A stylesheet in a directory that doesn't exist yet is watched once it does
+func TestMissingStyleDir(t *testing.T) {
+	dir := t.TempDir()
+	source := filepath.Join(dir, "doc.md")
+	if err := os.WriteFile(source, []byte("a\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	styleDir := filepath.Join(dir, "css")
+	d, err := NewDocument(source, Options{CSS: filepath.Join(styleDir, "style.css"), Debounce: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	if style := d.Style(); style != "" {
+		t.Errorf("got style %q", style)
+	}
+	changes := make(chan struct{}, 10)
+	go d.Watch(func() { changes <- struct{}{} })
+
+	if err := os.Mkdir(styleDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	waitForChange(t, changes, "creating the stylesheet directory")
+	if err := os.WriteFile(filepath.Join(styleDir, "style.css"), []byte("body {}\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	waitForChange(t, changes, "writing the stylesheet")
+	if style := d.Style(); style != "body {}\n" {
+		t.Errorf("got style %q", style)
+	}
+}
+
+// A render that takes too long gives up, without blocking the document
+func TestRenderTimeout(t *testing.T) {
+	source := filepath.Join(t.TempDir(), "doc.md")
+	if err := os.WriteFile(source, []byte("# Title\n\n![](a.png)\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	d, err := NewDocument(source, Options{NoWatch: true, RenderTimeout: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	// A first render, so there are results while the slow one runs
+	if _, _, err := d.Render(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	release := make(chan struct{})
+	started := make(chan struct{}, 1)
+	convert := d.convert
+	d.convert = func(r io.Reader, w io.Writer) error {
+		started <- struct{}{}
+		<-release
+		return convert(r, w)
+	}
+
+	start := time.Now()
+	if _, _, err := d.Render(context.Background()); err == nil || !strings.Contains(err.Error(), "longer than") {
+		t.Errorf("got error %v, want a timeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("timeout took %v", elapsed)
+	}
+	<-started
+
+	// The conversion still runs, but doesn't block the results of the last
+	// one
+	done := make(chan struct{})
+	go func() {
+		d.Words()
+		d.isImage(filepath.Join(filepath.Dir(source), "a.png"))
+		d.ImageData("a.png")
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("document is blocked by the conversion")
+	}
+
+	// A canceled render stops waiting for it
+	ctx, cancel := context.WithCancel(context.Background())
+	d.timeout = 0
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+	if _, _, err := d.Render(ctx); err != context.Canceled {
+		t.Errorf("got error %v, want %v", err, context.Canceled)
+	}
+
+	// The next render waits for the conversion to finish
+	close(release)
+	d.convert = convert
+	content, title, err := d.Render(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if title != "Title" || !strings.Contains(content, "<h1") {
+		t.Errorf("got title %q and content %q", title, content)
+	}
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"context"
+	"io"
+
+	"github.com/remko/mdvy/render"
+)
+
+// Writes source as a standalone HTML document.
+func Export(source string, opts Options, w io.Writer) error {
+	opts.NoWatch = true
+	doc, err := NewDocument(source, opts)
+	if err != nil {
+		return err
+	}
+	content, title, err := doc.Render(context.Background())
+	if err != nil {
+		return err
+	}
+	return render.WriteDocument(w, title, content, doc.Style())
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+)
+
+// Window size, font size and theme, persisted between runs.
+// The webview doesn't expose the window position, so only the size is kept.
+type Geometry struct {
+	Width    int    `json:"width"`
+	Height   int    `json:"height"`
+	FontSize int    `json:"fontSize,omitempty"`
+	Theme    string `json:"theme,omitempty"`
+}
+
+const minGeometrySize = 100
+
+func (g Geometry) Valid() bool {
+	return g.Width >= minGeometrySize && g.Height >= minGeometrySize
+}
+
+func geometryPath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "mdvy", "geometry.json"), nil
+}
+
+func LoadGeometry() (Geometry, error) {
+	var g Geometry
+	p, err := geometryPath()
+	if err != nil {
+		return g, err
+	}
+	data, err := os.ReadFile(p)
+	if err != nil {
+		return g, err
+	}
+	err = json.Unmarshal(data, &g)
+	return g, err
+}
+
+func SaveGeometry(g Geometry) error {
+	p, err := geometryPath()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		return err
+	}
+	data, err := json.Marshal(g)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(p, data, 0o644)
+}
+
+// Saves the parts of g that are set, keeping the previously saved values for
+// the rest.
+func UpdateGeometry(g Geometry) error {
+	old, _ := LoadGeometry()
+	if !g.Valid() {
+		g.Width, g.Height = old.Width, old.Height
+	}
+	if g.FontSize <= 0 {
+		g.FontSize = old.FontSize
+	}
+	if g.Theme == "" {
+		g.Theme = old.Theme
+	}
+	if g == old {
+		return nil
+	}
+	return SaveGeometry(g)
+}
@@ -7,6 +7,11 @@ require (
 	github.com/pkg/browser v0.0.0-20210911075715-681adbf594b8
 	github.com/webview/webview_go v0.0.0-20230901181450-5a14030a9070
 	github.com/yuin/goldmark v1.5.6
+	github.com/yuin/goldmark-emoji v1.0.2
+	github.com/yuin/goldmark-meta v1.1.0
 )
 
-require golang.org/x/sys v0.12.0 // indirect
+require (
+	golang.org/x/sys v0.12.0 // indirect
+	gopkg.in/yaml.v2 v2.3.0 // indirect
+)
@@ -0,0 +1,26 @@
+package main
+
+import "log"
+
+// Log levels, set with -quiet and -v. Errors are always logged.
+const (
+	logQuiet = iota
+	logNormal
+	logVerbose
+)
+
+var logLevel = logNormal
+
+// Logs routine messages, unless running with -quiet
+func infof(format string, args ...any) {
+	if logLevel >= logNormal {
+		log.Printf(format, args...)
+	}
+}
+
+// Logs details that are only useful for debugging, with -v
+func debugf(format string, args ...any) {
+	if logLevel >= logVerbose {
+		log.Printf(format, args...)
+	}
+}
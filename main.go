@@ -2,6 +2,8 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
 	_ "embed"
 	"encoding/json"
 	"errors"
@@ -9,98 +11,388 @@ import (
 	"fmt"
 	"html/template"
 	"io"
+	"io/fs"
 	"log"
+	"net/url"
 	"os"
-	"path"
+	"os/exec"
 	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime/debug"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
+	texttemplate "text/template"
 	"time"
 
-	"github.com/fsnotify/fsnotify"
 	"github.com/pkg/browser"
+	"github.com/remko/mdvy/render"
 	webview "github.com/webview/webview_go"
-	"github.com/yuin/goldmark"
-	"github.com/yuin/goldmark/extension"
-	"github.com/yuin/goldmark/renderer/html"
 )
 
-//go:embed style.css
-var style string
+// Build information, set with -ldflags "-X main.version=..."
+var (
+	version = "dev"
+	commit  = ""
+	date    = ""
+)
+
+// Falls back to the module version when installed with go install
+func versionString() string {
+	v := version
+	if info, ok := debug.ReadBuildInfo(); ok && v == "dev" && info.Main.Version != "" && info.Main.Version != "(devel)" {
+		v = info.Main.Version
+	}
+	if commit != "" {
+		v += " (" + commit
+		if date != "" {
+			v += ", " + date
+		}
+		v += ")"
+	}
+	return v
+}
 
 //go:embed script.js
 var script string
 
-var tmpl = template.Must(template.New("index").Parse(`
+var tmpl = template.Must(template.New("index").Parse(`<!DOCTYPE html>
+<meta charset="utf-8">
 <style>{{.Style}}</style>
-<body>
+<style>{{.OptionStyle}}</style>
+<style id="user-style"></style>
+<body class="{{.Theme}}{{if .Bare}} bare{{end}}" data-theme="{{.Theme}}" data-edit="{{.Edit}}" data-line-numbers="{{.LineNumbers}}" data-reload-on-focus="{{.ReloadOnFocus}}" data-x="{{.X}}" data-y="{{.Y}}">
+	<div id="tabs" hidden></div>
+	<nav id="toc">
+		<button id="toc-toggle" title="Table of contents (t)">&#9776;</button>
+		<ul></ul>
+	</nav>
+	<div id="search" hidden>
+		<input type="search" placeholder="Find">
+		<span class="count"></span>
+	</div>
+	<div id="error" role="alert" hidden></div>
 	<div id="content"></div>
+	<pre id="source" hidden></pre>
+	<div id="status"><span class="source"></span><span class="info"></span></div>
+	{{if .Shim}}<script>{{.Shim}}</script>{{end}}
 	<script>{{.Script}}</script>
 </body>
 `))
 
-type View struct {
-	source string
-	md     goldmark.Markdown
-	wv     webview.WebView
-	fsw    *fsnotify.Watcher
-	gt     Gemtext
+// Returns the viewer page. shim defines the bindings when the page is not
+// running inside the webview.
+func viewerHTML(opts Options, shim string) ([]byte, error) {
+	style, script, err := assets(opts)
+	if err != nil {
+		return nil, err
+	}
+	var html bytes.Buffer
+	err = tmpl.Execute(&html, struct {
+		Style       template.CSS
+		OptionStyle template.CSS
+		Script      template.JS
+		Shim        template.JS
+		Options
+	}{Style: template.CSS(style), OptionStyle: optionStyle(opts), Script: template.JS(script), Shim: template.JS(shim), Options: opts})
+	return html.Bytes(), err
 }
 
-func NewView(source string) (*View, error) {
-	var md goldmark.Markdown
-	if !strings.HasSuffix(source, ".gmi") {
-		md = goldmark.New(
-			goldmark.WithExtensions(extension.GFM, extension.Typographer),
-			// goldmark.WithParserOptions(
-			// 	parser.WithAutoHeadingID(),
-			// ),
-			goldmark.WithRendererOptions(
-				html.WithUnsafe()),
-		)
+// Returns the style and script of the viewer. With -dev, they are read from
+// the working directory instead of the embedded copies.
+func assets(opts Options) (string, string, error) {
+	if !opts.Dev {
+		return render.Style, script, nil
 	}
+	devStyle, err := os.ReadFile("render/style.css")
+	if err != nil {
+		return "", "", err
+	}
+	devScript, err := os.ReadFile("script.js")
+	if err != nil {
+		return "", "", err
+	}
+	return string(devStyle), string(devScript), nil
+}
 
-	fsw, err := fsnotify.NewWatcher()
+// Overrides the default font and width variables of style.css
+func optionStyle(opts Options) template.CSS {
+	var css strings.Builder
+	css.WriteString("body {")
+	if opts.Font != "" {
+		fmt.Fprintf(&css, " --font-family: %s;", opts.Font)
+	}
+	if opts.FontSize > 0 {
+		fmt.Fprintf(&css, " --font-size: %dpx;", opts.FontSize)
+	}
+	if opts.MaxWidth != "" {
+		fmt.Fprintf(&css, " --max-width: %s;", cssLength(opts.MaxWidth))
+	}
+	css.WriteString(" }")
+	return template.CSS(css.String())
+}
+
+// A CSS length, or a number of pixels. Zero is no limit.
+var maxWidthRE = regexp.MustCompile(`^(none|\d+(\.\d+)?(px|em|rem|ch|%)?)$`)
+
+// Returns the CSS value of a -max-width length
+func cssLength(s string) string {
+	if n, err := strconv.ParseFloat(s, 64); err == nil {
+		if n == 0 {
+			return "none"
+		}
+		return s + "px"
+	}
+	return s
+}
+
+// Color themes, defined in style.css (and listed in script.js too)
+var themes = []string{"auto", "light", "dark", "github", "solarized", "sepia"}
+
+type Options struct {
+	render.Options
+	NoWatch         bool
+	Width           int
+	Height          int
+	X               int // Window position, or -1 to leave it to the system
+	Y               int
+	PersistGeometry bool
+	Debounce        time.Duration
+	RenderTimeout   time.Duration
+	Theme           string
+	Bare            bool // Show only the content, without status bar and such
+	Edit            bool
+	LineNumbers     bool
+	CSS             string
+	Font            string
+	FontSize        int
+	MaxWidth        string // CSS length, or "" for the default
+	GeminiHandler   string // Command to open gemini:// links with
+	FollowLocal     bool
+	ReloadOnFocus   bool
+	Dev             bool
+	Title           string
+}
+
+// Formats the window title with the -title template. title is the title of
+// the document, and source its path.
+func windowTitle(opts Options, source string, title string) string {
+	if opts.Title == "" {
+		return title
+	}
+	t, err := texttemplate.New("title").Parse(opts.Title)
 	if err != nil {
-		return nil, err
+		return title
 	}
-	err = fsw.Add(path.Dir(source))
+	var s strings.Builder
+	err = t.Execute(&s, struct {
+		Title string
+		Base  string
+		Path  string
+	}{Title: title, Base: filepath.Base(source), Path: source})
 	if err != nil {
-		return nil, err
+		return title
+	}
+	return s.String()
+}
+
+// A document shown in a tab of the view
+type tab struct {
+	doc     *Document
+	history []string // Previously shown sources, with -follow-local
+}
+
+type View struct {
+	wv   webview.WebView
+	opts Options
+
+	mu       sync.Mutex
+	tabs     []*tab
+	current  int
+	geometry Geometry
+	cancel   context.CancelFunc // Cancels the render in progress
+	page     []byte             // Last loaded viewer page
+	shown    [sha256.Size]byte  // Hash of the last shown render, or zero
+}
+
+// Returned by NewView when the window can't be created (e.g. without a display
+// on Linux)
+var errNoWindow = errors.New("cannot open a window (is there a display, and are GTK and WebKitGTK installed?)")
+
+// webview.New doesn't report errors, but returns a webview without native
+// handle, on which every call crashes. There is no API to check the handle,
+// so this looks at the unexported field w (a C.webview_t) of the webview
+// struct, as of webview_go v0.0.0-20230901181450-5a14030a9070. If a later
+// version changes the struct, this is logged, and the webview is assumed to
+// be created.
+func webviewCreated(wv webview.WebView) bool {
+	if wv == nil {
+		return false
+	}
+	handle, err := webviewHandle(wv)
+	if err != nil {
+		log.Printf("cannot check if the window was created: %v", err)
+		return true
+	}
+	return !handle.IsNil()
+}
+
+// Returns the native handle of wv (see webviewCreated)
+func webviewHandle(wv webview.WebView) (reflect.Value, error) {
+	v := reflect.ValueOf(wv)
+	if v.Kind() != reflect.Pointer || v.Elem().Kind() != reflect.Struct {
+		return reflect.Value{}, fmt.Errorf("unexpected webview type %T", wv)
+	}
+	handle := v.Elem().FieldByName("w")
+	if !handle.IsValid() || handle.Kind() != reflect.UnsafePointer {
+		return reflect.Value{}, fmt.Errorf("%T has no pointer field w", wv)
+	}
+	return handle, nil
+}
+
+func NewView(sources []string, opts Options) (*View, error) {
+	var tabs []*tab
+	for _, source := range sources {
+		doc, err := NewDocument(source, opts)
+		if err != nil {
+			for _, t := range tabs {
+				t.doc.Close()
+			}
+			return nil, err
+		}
+		tabs = append(tabs, &tab{doc: doc})
 	}
 
 	wv := webview.New(true)
-	wv.SetTitle(source)
-	wv.SetSize(600, 800, webview.HintNone)
+	if !webviewCreated(wv) {
+		for _, t := range tabs {
+			t.doc.Close()
+		}
+		return nil, errNoWindow
+	}
+	wv.SetTitle(windowTitle(opts, tabs[0].doc.title, filepath.Base(tabs[0].doc.title)))
+	wv.SetSize(opts.Width, opts.Height, webview.HintNone)
 
-	var html bytes.Buffer
-	err = tmpl.Execute(&html, struct {
-		Style  template.CSS
-		Script template.JS
-	}{Style: template.CSS(style), Script: template.JS(script)})
+	html, err := viewerHTML(opts, "")
 	if err != nil {
 		return nil, err
 	}
-	wv.SetHtml(string(html.Bytes()))
+	wv.SetHtml(string(html))
 
 	view := &View{
-		source: source,
-		md:     md,
-		fsw:    fsw,
-		wv:     wv,
+		wv:   wv,
+		opts: opts,
+		tabs: tabs,
+		page: html,
 	}
 
+	// Bindings run on the UI thread, so the ones that render or write the
+	// document do so in the background
 	err = wv.Bind("onReady", func() {
-		err = view.render()
-		if err != nil {
-			log.Printf("render error: %v", err)
+		// The page is empty, so render even if nothing changed
+		view.mu.Lock()
+		view.shown = [sha256.Size]byte{}
+		view.mu.Unlock()
+		go view.update()
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = wv.Bind("reload", func() {
+		go view.update()
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = wv.Bind("setTask", func(index int, checked bool) error {
+		if !opts.Edit {
+			return errors.New("editing is disabled")
 		}
+		doc := view.document()
+		go func() {
+			if err := doc.SetTask(index, checked); err != nil {
+				view.showError(err)
+			}
+		}()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = wv.Bind("setGeometry", func(width int, height int) {
+		view.mu.Lock()
+		defer view.mu.Unlock()
+		view.geometry.Width, view.geometry.Height = width, height
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = wv.Bind("setFontSize", func(size int) {
+		view.mu.Lock()
+		defer view.mu.Unlock()
+		view.geometry.FontSize = size
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = wv.Bind("saveTheme", func(theme string) {
+		view.mu.Lock()
+		defer view.mu.Unlock()
+		view.geometry.Theme = theme
 	})
 	if err != nil {
 		return nil, err
 	}
 	err = wv.Bind("openURL", func(url string) error {
-		return browser.OpenURL(url)
+		if opts.FollowLocal {
+			if source, anchor := localDocument(view.document().dir(), url); source != "" {
+				return view.follow(source, anchor)
+			}
+		}
+		switch urlAction(url, opts) {
+		case openURL:
+			return browser.OpenURL(url)
+		case openGeminiURL:
+			return runHandler(opts.GeminiHandler, url)
+		case openURLLogged:
+			infof("opening local file: %s", url)
+			return browser.OpenURL(url)
+		default:
+			infof("not opening url: %s", url)
+			return fmt.Errorf("refusing to open url: %s", url)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = wv.Bind("loadImage", func(src string) (string, error) {
+		return view.document().ImageData(src)
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = wv.Bind("getSource", func() (string, error) {
+		return view.document().Source()
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = wv.Bind("back", func() error {
+		return view.back()
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = wv.Bind("selectTab", func(index int) error {
+		return view.selectTab(index)
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = wv.Bind("closeTab", func(index int) error {
+		return view.closeTab(index)
 	})
 	if err != nil {
 		return nil, err
@@ -116,123 +408,661 @@ func NewView(source string) (*View, error) {
 }
 
 func (v *View) Run() {
-	go v.watch()
+	for _, t := range v.tabs {
+		go v.watch(t.doc)
+	}
 	v.wv.Run()
-	v.fsw.Close()
+	v.mu.Lock()
+	for _, t := range v.tabs {
+		t.doc.Close()
+	}
+	v.mu.Unlock()
 	v.wv.Destroy()
+	if v.opts.PersistGeometry {
+		v.mu.Lock()
+		g := v.geometry
+		v.mu.Unlock()
+		if err := UpdateGeometry(g); err != nil {
+			log.Printf("error saving window geometry: %v", err)
+		}
+	}
 }
 
-func (v *View) render() error {
-	inputf, err := os.Open(v.source)
+// Re-renders when doc changes while it is the shown document
+func (v *View) watch(doc *Document) {
+	doc.Watch(func() {
+		if v.document() != doc {
+			return
+		}
+		v.update()
+	})
+}
+
+// Renders, logging errors (which are shown in the page already)
+func (v *View) update() {
+	if err := v.render(); err != nil {
+		infof("render error: %v", err)
+	}
+}
+
+// Returns the document of the current tab
+func (v *View) document() *Document {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.tabs[v.current].doc
+}
+
+func (v *View) selectTab(index int) error {
+	v.mu.Lock()
+	if index < 0 || index >= len(v.tabs) {
+		v.mu.Unlock()
+		return fmt.Errorf("tab %d not found", index)
+	}
+	v.current = index
+	v.mu.Unlock()
+	return v.show("")
+}
+
+// Closes the tab, and quits when it was the last one
+func (v *View) closeTab(index int) error {
+	v.mu.Lock()
+	if index < 0 || index >= len(v.tabs) {
+		v.mu.Unlock()
+		return fmt.Errorf("tab %d not found", index)
+	}
+	if len(v.tabs) == 1 {
+		v.mu.Unlock()
+		v.wv.Terminate()
+		return nil
+	}
+	v.tabs[index].doc.Close()
+	v.tabs = append(v.tabs[:index], v.tabs[index+1:]...)
+	if v.current >= index && v.current > 0 {
+		v.current--
+	}
+	v.mu.Unlock()
+	return v.show("")
+}
+
+// Shows the local document source in the current tab, scrolled to anchor
+func (v *View) follow(source string, anchor string) error {
+	prev := v.document().source
+	if err := v.open(source, anchor); err != nil {
+		return err
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	t := v.tabs[v.current]
+	t.history = append(t.history, prev)
+	return nil
+}
+
+// Goes back to the previously shown document of the current tab
+func (v *View) back() error {
+	v.mu.Lock()
+	t := v.tabs[v.current]
+	if len(t.history) == 0 {
+		v.mu.Unlock()
+		return nil
+	}
+	source := t.history[len(t.history)-1]
+	t.history = t.history[:len(t.history)-1]
+	v.mu.Unlock()
+	return v.open(source, "")
+}
+
+// Replaces the document of the current tab, and watches the new one instead
+func (v *View) open(source string, anchor string) error {
+	opts := v.opts
+	opts.Format = ""
+	doc, err := NewDocument(source, opts)
 	if err != nil {
 		return err
 	}
+	v.mu.Lock()
+	t := v.tabs[v.current]
+	prev := t.doc
+	t.doc = doc
+	v.mu.Unlock()
+	prev.Close()
+	go v.watch(doc)
+	return v.show(anchor)
+}
 
-	var content bytes.Buffer
-	if v.md != nil {
-		input, err := io.ReadAll(inputf)
-		if err != nil {
-			return err
-		}
-		if err := v.md.Convert(input, &content); err != nil {
-			return err
+// Renders a document that wasn't shown before, scrolled to anchor. The render
+// runs in the background, as this is called from bindings.
+func (v *View) show(anchor string) error {
+	anchorjson, err := json.Marshal(anchor)
+	if err != nil {
+		return err
+	}
+	go func() {
+		if err := v.render(); err != nil {
+			infof("render error: %v", err)
+			return
 		}
-	} else {
-		gt, err := ParseGemtext(inputf)
+		v.wv.Dispatch(func() {
+			v.wv.Eval(fmt.Sprintf(`scrollToAnchor(%s)`, anchorjson))
+		})
+	}()
+	return nil
+}
+
+// Renders the current document. Starting a new render cancels the one in
+// progress, so only the latest result is shown.
+func (v *View) render() error {
+	if v.opts.Dev {
+		// Reload the page when the assets changed, which renders again when ready
+		html, err := viewerHTML(v.opts, "")
 		if err != nil {
+			v.showError(err)
 			return err
 		}
-		if err := GemtextToHTML(gt, v.gt, &content); err != nil {
-			return err
+		v.mu.Lock()
+		changed := !bytes.Equal(html, v.page)
+		v.page = html
+		v.mu.Unlock()
+		if changed {
+			v.wv.Dispatch(func() {
+				v.wv.SetHtml(string(html))
+			})
+			return nil
 		}
-		v.gt = gt
-		// log.Printf("%s", gt, content.String())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	v.mu.Lock()
+	if v.cancel != nil {
+		v.cancel()
+	}
+	v.cancel = cancel
+	doc := v.tabs[v.current].doc
+	var names []string
+	for _, t := range v.tabs {
+		names = append(names, filepath.Base(t.doc.title))
+	}
+	tabsjson, err := json.Marshal(names)
+	current := v.current
+	v.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	content, title, err := doc.Render(ctx)
+	if ctx.Err() != nil {
+		return nil
+	} else if err != nil {
+		v.showError(err)
+		return err
 	}
 
 	// log.Printf("html: %s", content)
-	contentjson, err := json.Marshal(string(content.Bytes()))
+	contentjson, err := json.Marshal(content)
 	if err != nil {
 		return err
 	}
-	eval := fmt.Sprintf(`setContent(%s)`, contentjson)
+	stylejson, err := json.Marshal(doc.Style())
+	if err != nil {
+		return err
+	}
+	eval := fmt.Sprintf(`setError(""); setTabs(%s, %d); setStyle(%s); setWordCount(%d); setContent(%s)`, tabsjson, current, stylejson, doc.Words(), contentjson)
+	// Checked with the lock held, so a newer render can't dispatch before it
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if ctx.Err() != nil {
+		return nil
+	}
+	// Editors can truncate a file before writing it, so an empty document
+	// is only shown if nothing was shown yet. Unchanged renders (e.g. after a
+	// save without changes) are skipped too.
+	// The render time is left out of the comparison, and still updated for
+	// unchanged renders, to show the preview is live.
+	pathjson, err := json.Marshal(doc.Path())
+	if err != nil {
+		return err
+	}
+	status := fmt.Sprintf(`setStatus(%s, %d)`, pathjson, time.Now().UnixMilli())
+	hash := sha256.Sum256([]byte(eval))
+	if strings.TrimSpace(content) == "" && v.shown != [sha256.Size]byte{} {
+		debugf("skipping empty render")
+		return nil
+	} else if hash == v.shown {
+		debugf("skipping unchanged render")
+		v.wv.Dispatch(func() { v.wv.Eval(status) })
+		return nil
+	}
+	v.shown = hash
 	v.wv.Dispatch(func() {
-		v.wv.Eval(eval)
+		v.wv.SetTitle(windowTitle(v.opts, doc.title, title))
+		v.wv.Eval(eval + "; " + status)
 	})
 	return nil
 
 }
 
-func (v *View) watch() {
-	debounce := NewDebouncer(500 * time.Millisecond)
-	for {
-		select {
-		case event, ok := <-v.fsw.Events:
-			if !ok {
-				return
-			}
-			log.Printf("event: %v", event)
-			if filepath.Clean(event.Name) == v.source && (event.Has(fsnotify.Write) || event.Has(fsnotify.Create)) {
-				debounce(func() {
-					err := v.render()
-					if err != nil {
-						log.Printf("render error: %v", err)
-					}
-				})
-			}
+// Shows the error above the (stale) content, until the next render
+func (v *View) showError(err error) {
+	v.mu.Lock()
+	v.shown = [sha256.Size]byte{}
+	v.mu.Unlock()
+	errjson, jerr := json.Marshal(err.Error())
+	if jerr != nil {
+		return
+	}
+	v.wv.Dispatch(func() {
+		v.wv.Eval(fmt.Sprintf(`setError(%s)`, errjson))
+	})
+}
 
-		case err, ok := <-v.fsw.Errors:
-			if !ok {
-				return
-			}
-			log.Println("watcher error:", err)
+////////////////////////////////////////////////////////////////////////////////
+// Links
+////////////////////////////////////////////////////////////////////////////////
+
+const (
+	rejectURL = iota
+	openURL
+	openURLLogged
+	openGeminiURL // With -gemini-handler
+)
+
+// Returns the markdown or Gemtext file a relative link (from dir) points to,
+// and the anchor within it. Returns an empty source if it isn't a local
+// document.
+func localDocument(dir string, href string) (source string, anchor string) {
+	u, err := url.Parse(href)
+	if err != nil || u.Scheme != "" || u.Host != "" || u.Path == "" {
+		return "", ""
+	}
+	p := filepath.FromSlash(u.Path)
+	if !filepath.IsAbs(p) {
+		p = filepath.Join(dir, p)
+	}
+	if render.FormatFromExtension(p) == "" {
+		return "", ""
+	}
+	if info, err := os.Stat(p); err != nil || info.IsDir() {
+		return "", ""
+	}
+	return filepath.Clean(p), u.Fragment
+}
+
+// Decides what to do with a link by its scheme. Schemes that can run code
+// (javascript:, data:) and unknown ones are never opened.
+func urlAction(rawURL string, opts Options) int {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rejectURL
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "gemini":
+		if opts.GeminiHandler != "" {
+			return openGeminiURL
 		}
+		return openURL
+	case "http", "https", "mailto":
+		return openURL
+	case "file":
+		return openURLLogged
+	default:
+		return rejectURL
 	}
 }
 
+// Starts a handler command (e.g. "amfora" or "lagrange --new-tab") with the
+// URL as last argument, without waiting for it.
+func runHandler(handler string, url string) error {
+	fields := strings.Fields(handler)
+	if len(fields) == 0 {
+		return errors.New("no handler command")
+	}
+	args := append(fields, url)
+	cmd := exec.Command(args[0], args[1:]...)
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	infof("opening %s with %s", url, args[0])
+	go cmd.Wait()
+	return nil
+}
+
 ////////////////////////////////////////////////////////////////////////////////
 // Debounce
 ////////////////////////////////////////////////////////////////////////////////
 
-type debouncer struct {
+// Delays calls until there were no new calls for a while. Only the last
+// function is called.
+type Debouncer struct {
 	mu    sync.Mutex
 	after time.Duration
-	timer *time.Timer
+	timer stopper
+	f     func() // Pending function
+	gen   int    // Identifies the timer of the pending function
+
+	// Starts a timer, like time.AfterFunc (which tests replace)
+	afterFunc func(time.Duration, func()) stopper
+}
+
+// A timer, as returned by time.AfterFunc
+type stopper interface {
+	Stop() bool
 }
 
-func NewDebouncer(after time.Duration) func(f func()) {
-	d := &debouncer{after: after}
+func NewDebouncer(after time.Duration) *Debouncer {
+	return &Debouncer{after: after, afterFunc: func(d time.Duration, f func()) stopper {
+		return time.AfterFunc(d, f)
+	}}
+}
 
-	return func(f func()) {
-		d.add(f)
-	}
+// Calls f after the delay, unless another function is added before that.
+func (d *Debouncer) Add(f func()) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.stop()
+	d.f = f
+	gen := d.gen
+	d.timer = d.afterFunc(d.after, func() {
+		d.fire(gen)
+	})
 }
 
-func (d *debouncer) add(f func()) {
+// Drops the pending function, if any.
+func (d *Debouncer) Cancel() {
 	d.mu.Lock()
 	defer d.mu.Unlock()
+	d.stop()
+	d.f = nil
+}
+
+// Calls the pending function (if any) now, instead of after the delay.
+func (d *Debouncer) Flush() {
+	d.mu.Lock()
+	d.stop()
+	f := d.f
+	d.f = nil
+	d.mu.Unlock()
+	if f != nil {
+		f()
+	}
+}
 
+// Stops the timer. A timer that already fired sees that it is outdated.
+func (d *Debouncer) stop() {
 	if d.timer != nil {
 		d.timer.Stop()
+		d.timer = nil
+	}
+	d.gen++
+}
+
+func (d *Debouncer) fire(gen int) {
+	d.mu.Lock()
+	f := d.f
+	if gen != d.gen {
+		f = nil
+	} else {
+		d.f = nil
+	}
+	d.mu.Unlock()
+	if f != nil {
+		f()
 	}
-	d.timer = time.AfterFunc(d.after, f)
 }
 
 ////////////////////////////////////////////////////////////////////////////////
 
 func main_() error {
+	var opts Options
+	flag.BoolVar(&opts.NoWatch, "no-watch", false, "render once, without watching the file for changes")
+	flag.IntVar(&opts.Width, "width", 600, "window width")
+	flag.IntVar(&opts.Height, "height", 800, "window height")
+	flag.IntVar(&opts.X, "x", -1, "horizontal window position, where the platform allows it")
+	flag.IntVar(&opts.Y, "y", -1, "vertical window position, where the platform allows it")
+	flag.BoolVar(&opts.ReloadOnFocus, "reload-on-focus", false, "also re-render when the window gets focus, for file systems where changes are missed")
+	flag.DurationVar(&opts.Debounce, "debounce", 500*time.Millisecond, "delay before re-rendering after a change")
+	flag.DurationVar(&opts.RenderTimeout, "render-timeout", 10*time.Second, "show an error instead of waiting longer for a render, or 0 to wait as long as it takes")
+	flag.StringVar(&opts.Theme, "theme", "auto", "color theme: auto to follow the system, light, dark, github, solarized or sepia (Shift+T switches)")
+	flag.StringVar(&opts.Format, "format", "", "input format: md or gemtext (default: detect from the extension or content)")
+	flag.StringVar(&opts.Encoding, "encoding", "", "input encoding: utf-8, utf-16le, utf-16be or latin-1 (default: from the byte order mark, or utf-8)")
+	flag.StringVar(&opts.Title, "title", "{{.Title}}", "window title `template`, with the document .Title (from the frontmatter or first heading), and the file .Base and .Path")
+	flag.StringVar(&opts.Font, "font", "", "font family (e.g. Georgia, serif)")
+	flag.IntVar(&opts.FontSize, "font-size", 0, "base font size in pixels (default 16)")
+	flag.StringVar(&opts.MaxWidth, "max-width", "", "maximum content `width` in pixels or as a CSS length (e.g. 60em), or 0 for none (default 48em)")
+	flag.BoolVar(&opts.Bare, "bare", false, "show only the content, without tabs, table of contents, search, status bar and padding (e.g. for screenshots)")
+	flag.StringVar(&opts.CSS, "css", "", "stylesheet `file` applied after the built-in style")
+	flag.BoolVar(&opts.LineNumbers, "line-numbers", false, "show line numbers in code blocks")
+	flag.BoolVar(&opts.Inline, "inline", false, "format **bold**, *italic*, ~~strikethrough~~ and code spans in Gemtext")
+	flag.BoolVar(&opts.Linkify, "linkify", false, "link bare URLs in Gemtext text")
+	flag.BoolVar(&opts.InlineImages, "inline-images", false, "show Gemtext links to images as images")
+	flag.BoolVar(&opts.MergeLines, "merge-lines", false, "show consecutive text lines in Gemtext as one paragraph, with line breaks")
+	flag.BoolVar(&opts.OrderedLists, "ordered-lists", false, "render numbered lines (1. item) in Gemtext as ordered lists")
+	flag.BoolVar(&opts.NoMath, "no-math", false, "don't render $...$ and $$...$$ as math")
+	flag.StringVar(&opts.GeminiHandler, "gemini-handler", "", "open gemini:// links with `command` (e.g. amfora), which gets the URL as last argument, instead of the default browser")
+	flag.BoolVar(&opts.FollowLocal, "follow-local", false, "open links to local markdown and Gemtext files in the same window (Backspace goes back)")
+	flag.BoolVar(&opts.Safe, "safe", false, "don't pass through raw HTML in markdown, for untrusted documents")
+	flag.BoolVar(&opts.ShowComments, "show-comments", false, "show <!-- comments --> in markdown as annotations")
+	flag.BoolVar(&opts.Edit, "edit", false, "write task list check box changes back to the file")
+	flag.BoolVar(&opts.Dev, "dev", false, "read render/style.css and script.js from the source tree in the working directory on each render, for developing mdvy")
+	noPersist := flag.Bool("no-persist", false, "don't remember the window size between runs")
+	serve := flag.String("serve", "", "serve the document over HTTP on `address` (e.g. :8080) instead of opening a window")
+	output := flag.String("o", "", "export to a standalone HTML `file` instead of opening a window (- for stdout)")
+	to := flag.String("to", "", "convert the file to `format` (md or gemtext) on stdout instead of opening a window")
+	dumpAST := flag.Bool("dump-ast", false, "print the parsed Gemtext of the file as JSON instead of opening a window")
+	control := flag.String("control", "", "accept scroll requests from editors over HTTP on `address` (e.g. localhost:8081)")
+	noConfig := flag.Bool("no-config", false, "ignore the config file")
+	quiet := flag.Bool("quiet", false, "only log errors")
+	verbose := flag.Bool("v", false, "also log file system events")
+	showVersion := flag.Bool("version", false, "print the version and exit")
 	flag.Parse()
+	if *showVersion {
+		fmt.Printf("mdvy %s\n", versionString())
+		return nil
+	}
+	if *quiet {
+		logLevel = logQuiet
+	} else if *verbose {
+		logLevel = logVerbose
+	}
 	if len(flag.Args()) == 0 {
 		return errors.New("missing file")
 	}
-	inputp := flag.Args()[0]
-	view, err := NewView(filepath.Clean(inputp))
-	if err != nil {
+
+	// Flags on the command line take precedence over the config file
+	explicit := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+	if !*noConfig {
+		config, err := LoadConfig()
+		if err != nil {
+			return err
+		}
+		if err := applyConfig(flag.CommandLine, config, explicit); err != nil {
+			return err
+		}
+	}
+
+	if opts.Width <= 0 || opts.Height <= 0 {
+		return errors.New("window size must be positive")
+	}
+	if opts.FontSize < 0 {
+		return errors.New("font size must be positive")
+	}
+	if !slices.Contains(themes, opts.Theme) {
+		return fmt.Errorf("unknown theme: %s", opts.Theme)
+	}
+	if _, err := texttemplate.New("title").Parse(opts.Title); err != nil {
+		return fmt.Errorf("invalid title template: %w", err)
+	}
+	if opts.Format != "" && opts.Format != render.FormatMarkdown && opts.Format != render.FormatGemtext {
+		return fmt.Errorf("unknown format: %s", opts.Format)
+	}
+	if opts.MaxWidth != "" && !maxWidthRE.MatchString(opts.MaxWidth) {
+		return fmt.Errorf("invalid maximum width: %s", opts.MaxWidth)
+	}
+	if opts.GeminiHandler != "" && strings.TrimSpace(opts.GeminiHandler) == "" {
+		return errors.New("gemini handler must be a command")
+	}
+	if opts.Encoding != "" && !slices.Contains(render.Encodings, opts.Encoding) {
+		return fmt.Errorf("unknown encoding: %s", opts.Encoding)
+	}
+	opts.PersistGeometry = !*noPersist
+	if opts.PersistGeometry {
+		if err := restoreGeometry(&opts, explicit); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			log.Printf("error loading window geometry: %v", err)
+		}
+	}
+	var sources []string
+	for _, p := range flag.Args() {
+		sources = append(sources, filepath.Clean(p))
+	}
+	if len(sources) > 1 && (*output != "" || *serve != "" || *dumpAST || *to != "") {
+		return errors.New("only one file can be exported, converted, served or dumped")
+	}
+	if *dumpAST {
+		return dumpGemtext(sources[0], opts)
+	}
+	if *to != "" {
+		return convertTo(sources[0], opts, *to)
+	}
+	if *output != "" {
+		return export(sources[0], opts, *output)
+	}
+	if *serve != "" {
+		server, err := NewServer(sources[0], opts)
+		if err != nil {
+			return err
+		}
+		return server.ListenAndServe(*serve)
+	}
+	// Directories are shown as an index, with links to the documents in it
+	for _, source := range sources {
+		if info, err := os.Stat(source); err == nil && info.IsDir() {
+			opts.FollowLocal = true
+		}
+	}
+	view, err := NewView(sources, opts)
+	if errors.Is(err, errNoWindow) {
+		if len(sources) > 1 {
+			return fmt.Errorf("%w; use -serve to view a file in a browser", err)
+		}
+		log.Printf("%v; showing %s in the browser instead", err, sources[0])
+		return serveInBrowser(sources[0], opts)
+	} else if err != nil {
 		return err
 	}
+	if *control != "" {
+		go view.ListenControl(*control)
+	}
 	view.Run()
 	return nil
 }
 
+// Uses the saved window and font size and theme, unless they were given
+// explicitly
+func restoreGeometry(opts *Options, explicit map[string]bool) error {
+	g, err := LoadGeometry()
+	if err != nil {
+		return err
+	}
+	if !g.Valid() {
+		g.Width, g.Height = opts.Width, opts.Height
+	}
+	if g.FontSize <= 0 {
+		g.FontSize = opts.FontSize
+	}
+	if explicit["width"] {
+		g.Width = opts.Width
+	}
+	if explicit["height"] {
+		g.Height = opts.Height
+	}
+	if explicit["font-size"] {
+		g.FontSize = opts.FontSize
+	}
+	if !slices.Contains(themes, g.Theme) || explicit["theme"] {
+		g.Theme = opts.Theme
+	}
+	opts.Width, opts.Height, opts.FontSize, opts.Theme = g.Width, g.Height, g.FontSize, g.Theme
+	return nil
+}
+
+func export(source string, opts Options, output string) error {
+	if output == "-" {
+		return Export(source, opts, os.Stdout)
+	}
+	outf, err := os.Create(output)
+	if err != nil {
+		return err
+	}
+	if err := Export(source, opts, outf); err != nil {
+		outf.Close()
+		return err
+	}
+	return outf.Close()
+}
+
+// Parses the file (or stdin) as Gemtext
+func readGemtext(source string, opts Options) (render.Gemtext, error) {
+	r := os.Stdin
+	if source != stdinSource {
+		f, err := os.Open(source)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+	input, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if input, err = render.Decode(input, opts.Encoding); err != nil {
+		return nil, err
+	}
+	return render.ParseGemtext(bytes.NewReader(input), opts.Options)
+}
+
+func dumpGemtext(source string, opts Options) error {
+	gt, err := readGemtext(source, opts)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(gt)
+}
+
+// Writes the file converted to another format to stdout
+func convertTo(source string, opts Options, format string) error {
+	switch format {
+	case render.FormatMarkdown:
+		gt, err := readGemtext(source, opts)
+		if err != nil {
+			return err
+		}
+		return render.GemtextToMarkdown(gt, os.Stdout)
+	case render.FormatGemtext:
+		var input []byte
+		var err error
+		if source == stdinSource {
+			input, err = io.ReadAll(os.Stdin)
+		} else {
+			input, err = os.ReadFile(source)
+		}
+		if err != nil {
+			return err
+		}
+		if input, err = render.Decode(input, opts.Encoding); err != nil {
+			return err
+		}
+		return render.MarkdownToGemtext(input, opts.Options, os.Stdout)
+	default:
+		return fmt.Errorf("unknown output format: %s", format)
+	}
+}
+
 func main() {
 	if err := main_(); err != nil {
 		fmt.Printf("error: %s", err.Error())
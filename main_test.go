@@ -0,0 +1,374 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+	"unsafe"
+
+	webview "github.com/webview/webview_go"
+)
+
+func TestServerTask(t *testing.T) {
+	source := filepath.Join(t.TempDir(), "tasks.md")
+	if err := os.WriteFile(source, []byte("- [ ] task\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewServer(source, Options{Edit: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.doc.Close()
+
+	tests := []struct {
+		name        string
+		contentType string
+		origin      string
+		status      int
+		want        string
+	}{
+		{"form", "application/x-www-form-urlencoded", "", http.StatusUnsupportedMediaType, "- [ ] task\n"},
+		{"text", "text/plain", "", http.StatusUnsupportedMediaType, "- [ ] task\n"},
+		{"other site", "application/json", "http://example.com", http.StatusForbidden, "- [ ] task\n"},
+		{"viewer", "application/json", "http://localhost:8080", http.StatusOK, "- [x] task\n"},
+		{"no origin", "application/json; charset=utf-8", "", http.StatusOK, "- [x] task\n"},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodPost, "http://localhost:8080/task", strings.NewReader(`{"index": 0, "checked": true}`))
+		r.Header.Set("Content-Type", test.contentType)
+		if test.origin != "" {
+			r.Header.Set("Origin", test.origin)
+		}
+		w := httptest.NewRecorder()
+		s.handleTask(w, r)
+		if w.Code != test.status {
+			t.Errorf("%s: got status %d, want %d", test.name, w.Code, test.status)
+		}
+		if got, _ := os.ReadFile(source); string(got) != test.want {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+// Has the native handle field of webview_go's webview
+type fakeWebView struct {
+	webview.WebView
+	w unsafe.Pointer
+}
+
+func TestWebviewCreated(t *testing.T) {
+	var handle int
+	tests := []struct {
+		name string
+		wv   webview.WebView
+		want bool
+	}{
+		{"nil", nil, false},
+		{"no handle", &fakeWebView{}, false},
+		{"handle", &fakeWebView{w: unsafe.Pointer(&handle)}, true},
+		{"other struct", &struct{ webview.WebView }{}, true},
+		{"other handle", &struct {
+			webview.WebView
+			w uintptr
+		}{}, true},
+	}
+	for _, test := range tests {
+		if got := webviewCreated(test.wv); got != test.want {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+// Checks webviewCreated against the webview struct of the webview_go version
+// in use, which has no native handle without a display
+func TestWebviewLayout(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("a window can only be prevented on Linux")
+	}
+	t.Setenv("DISPLAY", "")
+	t.Setenv("WAYLAND_DISPLAY", "")
+	wv := webview.New(false)
+	if _, err := webviewHandle(wv); err != nil {
+		t.Fatal(err)
+	}
+	if webviewCreated(wv) {
+		wv.Destroy()
+		t.Error("got a window without a display")
+	}
+}
+
+func TestURLAction(t *testing.T) {
+	gemini := Options{GeminiHandler: "amfora"}
+	tests := []struct {
+		url  string
+		opts Options
+		want int
+	}{
+		{"https://example.com", Options{}, openURL},
+		{"HTTP://example.com", Options{}, openURL},
+		{"mailto:a@example.com", Options{}, openURL},
+		{"gemini://example.com", Options{}, openURL},
+		{"gemini://example.com", gemini, openGeminiURL},
+		{"https://example.com", gemini, openURL},
+		{"file:///etc/passwd", Options{}, openURLLogged},
+		{"javascript:alert(1)", Options{}, rejectURL},
+		{"data:text/html,<script>", Options{}, rejectURL},
+		{"ssh://example.com", Options{}, rejectURL},
+		{"relative/path", Options{}, rejectURL},
+		{"%zz", Options{}, rejectURL},
+	}
+	for _, test := range tests {
+		if got := urlAction(test.url, test.opts); got != test.want {
+			t.Errorf("%q: got %d, want %d", test.url, got, test.want)
+		}
+	}
+}
+
+func TestMaxWidth(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string // CSS value, or "" if invalid
+	}{
+		{"720", "720px"},
+		{"0", "none"},
+		{"0.0", "none"},
+		{"12.5", "12.5px"},
+		{"none", "none"},
+		{"40em", "40em"},
+		{"60ch", "60ch"},
+		{"80%", "80%"},
+		{"-1", ""},
+		{"10vw", ""},
+		{"1px; color: red", ""},
+		{"", ""},
+	}
+	for _, test := range tests {
+		if valid := maxWidthRE.MatchString(test.value); valid != (test.want != "") {
+			t.Errorf("%q: got valid %v", test.value, valid)
+			continue
+		}
+		if test.want == "" {
+			continue
+		}
+		if got := cssLength(test.value); got != test.want {
+			t.Errorf("%q: got %q, want %q", test.value, got, test.want)
+		}
+		style := string(optionStyle(Options{MaxWidth: test.value}))
+		if want := "--max-width: " + test.want + ";"; !strings.Contains(style, want) {
+			t.Errorf("%q: got style %q, want it to contain %q", test.value, style, want)
+		}
+	}
+	if style := string(optionStyle(Options{})); strings.Contains(style, "--max-width") {
+		t.Errorf("got style %q without -max-width", style)
+	}
+}
+
+func TestRunHandler(t *testing.T) {
+	for _, handler := range []string{"", " \t"} {
+		if err := runHandler(handler, "gemini://example.com"); err == nil {
+			t.Errorf("%q: got no error", handler)
+		}
+	}
+
+	if runtime.GOOS == "windows" {
+		t.Skip("needs a shell script as handler")
+	}
+	dir := t.TempDir()
+	out := filepath.Join(dir, "args")
+	script := filepath.Join(dir, "handler")
+	if err := os.WriteFile(script, []byte("#!/bin/sh\necho \"$@\" > "+out+".tmp && mv "+out+".tmp "+out+"\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := runHandler(script+"  --new-tab", "gemini://example.com/a b"); err != nil {
+		t.Fatal(err)
+	}
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		if args, err := os.ReadFile(out); err == nil {
+			if want := "--new-tab gemini://example.com/a b\n"; string(args) != want {
+				t.Errorf("got arguments %q, want %q", args, want)
+			}
+			return
+		}
+	}
+	t.Errorf("handler didn't run")
+}
+
+// Flags as main_ defines the ones in configDefaults
+func configFlags() *flag.FlagSet {
+	flags := flag.NewFlagSet("mdvy", flag.ContinueOnError)
+	flags.String("theme", "auto", "")
+	flags.String("font", "", "")
+	flags.Int("font-size", 0, "")
+	flags.Int("width", 600, "")
+	flags.Int("height", 800, "")
+	flags.Duration("debounce", 500*time.Millisecond, "")
+	return flags
+}
+
+func TestCreateConfig(t *testing.T) {
+	flags := configFlags()
+	if err := flags.Parse([]string{"-theme", "dark", "-width", "900", "-debounce", "1s"}); err != nil {
+		t.Fatal(err)
+	}
+	p := filepath.Join(t.TempDir(), "mdvy", "config.json")
+	if err := createConfig(p, flags); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got map[string]any
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]any{"theme": "auto", "font": "", "font-size": 0.0, "width": 600.0, "height": 800.0, "debounce": "500ms"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestApplyConfig(t *testing.T) {
+	tests := []struct {
+		config   string
+		explicit map[string]bool
+		flag     string
+		want     string
+	}{
+		{`{"width": 1000000}`, nil, "width", "1000000"},
+		{`{"width": 1000}`, map[string]bool{"width": true}, "width", "600"},
+		{`{"theme": "sepia"}`, nil, "theme", "sepia"},
+		{`{"debounce": "2s"}`, nil, "debounce", "2s"},
+	}
+	for _, test := range tests {
+		flags := configFlags()
+		var config map[string]any
+		if err := json.Unmarshal([]byte(test.config), &config); err != nil {
+			t.Fatal(err)
+		}
+		if err := applyConfig(flags, config, test.explicit); err != nil {
+			t.Errorf("%s: %v", test.config, err)
+			continue
+		}
+		if got := flags.Lookup(test.flag).Value.String(); got != test.want {
+			t.Errorf("%s: got %s, want %s", test.config, got, test.want)
+		}
+	}
+
+	for _, config := range []map[string]any{{"unknown": 1.0}, {"width": 1.5}, {"width": "wide"}} {
+		if err := applyConfig(configFlags(), config, nil); err == nil {
+			t.Errorf("%v: got no error", config)
+		}
+	}
+}
+
+// Clock for Debouncer, where time only passes with Advance
+type fakeClock struct {
+	now    time.Duration
+	timers []*fakeTimer
+}
+
+type fakeTimer struct {
+	at      time.Duration
+	f       func()
+	stopped bool
+	fired   bool
+}
+
+func (t *fakeTimer) Stop() bool {
+	active := !t.stopped && !t.fired
+	t.stopped = true
+	return active
+}
+
+func (c *fakeClock) AfterFunc(d time.Duration, f func()) stopper {
+	t := &fakeTimer{at: c.now + d, f: f}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.now += d
+	for _, t := range c.timers {
+		if !t.stopped && !t.fired && t.at <= c.now {
+			t.fired = true
+			t.f()
+		}
+	}
+}
+
+func TestDebouncer(t *testing.T) {
+	var calls []string
+	call := func(name string) func() {
+		return func() { calls = append(calls, name) }
+	}
+	tests := []struct {
+		name string
+		run  func(d *Debouncer, c *fakeClock)
+		want []string
+	}{
+		{"delay", func(d *Debouncer, c *fakeClock) {
+			d.Add(call("a"))
+			c.Advance(99 * time.Millisecond)
+			calls = append(calls, "99ms")
+			c.Advance(time.Millisecond)
+			c.Advance(time.Second)
+		}, []string{"99ms", "a"}},
+		{"last call", func(d *Debouncer, c *fakeClock) {
+			d.Add(call("a"))
+			c.Advance(50 * time.Millisecond)
+			d.Add(call("b"))
+			c.Advance(50 * time.Millisecond)
+			calls = append(calls, "100ms")
+			c.Advance(50 * time.Millisecond)
+		}, []string{"100ms", "b"}},
+		{"cancel", func(d *Debouncer, c *fakeClock) {
+			d.Add(call("a"))
+			d.Cancel()
+			c.Advance(time.Second)
+			d.Flush()
+		}, nil},
+		{"flush", func(d *Debouncer, c *fakeClock) {
+			d.Add(call("a"))
+			d.Flush()
+			calls = append(calls, "flushed")
+			c.Advance(time.Second)
+			d.Flush()
+		}, []string{"a", "flushed"}},
+		{"flush without pending call", func(d *Debouncer, c *fakeClock) {
+			d.Flush()
+		}, nil},
+		{"add after cancel", func(d *Debouncer, c *fakeClock) {
+			d.Add(call("a"))
+			d.Cancel()
+			d.Add(call("b"))
+			c.Advance(time.Second)
+		}, []string{"b"}},
+		// A timer that fires while it is being stopped does nothing
+		{"outdated timer", func(d *Debouncer, c *fakeClock) {
+			d.Add(call("a"))
+			d.Add(call("b"))
+			c.timers[0].f()
+			c.Advance(time.Second)
+		}, []string{"b"}},
+	}
+	for _, test := range tests {
+		calls = nil
+		c := &fakeClock{}
+		d := NewDebouncer(100 * time.Millisecond)
+		d.afterFunc = c.AfterFunc
+		test.run(d, c)
+		if !slices.Equal(calls, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, calls, test.want)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package render
+
+import (
+	"bytes"
+	"html"
+
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/parser"
+	"github.com/yuin/goldmark/renderer"
+	gmhtml "github.com/yuin/goldmark/renderer/html"
+	"github.com/yuin/goldmark/text"
+	"github.com/yuin/goldmark/util"
+)
+
+// Goldmark extension that shows HTML comments as annotations
+// (<aside class="comment"> and <span class="comment">), instead of passing
+// them through (or dropping them with Safe).
+var Comments = &commentsExtension{}
+
+var kindCommentBlock = ast.NewNodeKind("CommentBlock")
+var kindCommentInline = ast.NewNodeKind("CommentInline")
+
+type commentBlock struct {
+	ast.BaseBlock
+	text []byte
+}
+
+func (n *commentBlock) Kind() ast.NodeKind {
+	return kindCommentBlock
+}
+
+func (n *commentBlock) IsRaw() bool {
+	return true
+}
+
+func (n *commentBlock) Dump(source []byte, level int) {
+	ast.DumpHelper(n, source, level, map[string]string{"Text": string(n.text)}, nil)
+}
+
+type commentInline struct {
+	ast.BaseInline
+	text []byte
+}
+
+func (n *commentInline) Kind() ast.NodeKind {
+	return kindCommentInline
+}
+
+func (n *commentInline) Dump(source []byte, level int) {
+	ast.DumpHelper(n, source, level, map[string]string{"Text": string(n.text)}, nil)
+}
+
+// Returns the text of an HTML comment, or nil if raw isn't one
+func commentText(raw []byte) []byte {
+	raw = bytes.TrimSpace(raw)
+	if !bytes.HasPrefix(raw, []byte("<!--")) {
+		return nil
+	}
+	raw = raw[len("<!--"):]
+	if i := bytes.LastIndex(raw, []byte("-->")); i >= 0 {
+		raw = raw[:i]
+	}
+	return bytes.TrimSpace(raw)
+}
+
+type commentsTransformer struct{}
+
+func (t *commentsTransformer) Transform(doc *ast.Document, reader text.Reader, pc parser.Context) {
+	source := reader.Source()
+	var nodes []ast.Node
+	ast.Walk(doc, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		switch n := n.(type) {
+		case *ast.HTMLBlock:
+			if entering && n.HTMLBlockType == ast.HTMLBlockType2 {
+				nodes = append(nodes, n)
+			}
+		case *ast.RawHTML:
+			if entering && n.Segments.Len() > 0 {
+				segment := n.Segments.At(0)
+				if bytes.HasPrefix(segment.Value(source), []byte("<!--")) {
+					nodes = append(nodes, n)
+				}
+			}
+		}
+		return ast.WalkContinue, nil
+	})
+	for _, n := range nodes {
+		var raw bytes.Buffer
+		var c ast.Node
+		switch n := n.(type) {
+		case *ast.HTMLBlock:
+			lines := n.Lines()
+			for i := 0; i < lines.Len(); i++ {
+				line := lines.At(i)
+				raw.Write(line.Value(source))
+			}
+			if n.HasClosure() {
+				raw.Write(n.ClosureLine.Value(source))
+			}
+			block := &commentBlock{text: commentText(raw.Bytes())}
+			block.SetLines(lines)
+			c = block
+		case *ast.RawHTML:
+			for i := 0; i < n.Segments.Len(); i++ {
+				segment := n.Segments.At(i)
+				raw.Write(segment.Value(source))
+			}
+			c = &commentInline{text: commentText(raw.Bytes())}
+		}
+		for _, attr := range n.Attributes() {
+			c.SetAttribute(attr.Name, attr.Value)
+		}
+		n.Parent().ReplaceChild(n.Parent(), n, c)
+	}
+}
+
+type commentsRenderer struct{}
+
+func (r *commentsRenderer) RegisterFuncs(reg renderer.NodeRendererFuncRegisterer) {
+	reg.Register(kindCommentBlock, r.renderBlock)
+	reg.Register(kindCommentInline, r.renderInline)
+}
+
+func (r *commentsRenderer) renderBlock(w util.BufWriter, source []byte, n ast.Node, entering bool) (ast.WalkStatus, error) {
+	if entering {
+		w.WriteString(`<aside class="comment"`)
+		gmhtml.RenderAttributes(w, n, nil)
+		w.WriteString(">")
+		w.WriteString(html.EscapeString(string(n.(*commentBlock).text)))
+		w.WriteString("</aside>\n")
+	}
+	return ast.WalkContinue, nil
+}
+
+func (r *commentsRenderer) renderInline(w util.BufWriter, source []byte, n ast.Node, entering bool) (ast.WalkStatus, error) {
+	if entering {
+		w.WriteString(`<span class="comment">`)
+		w.WriteString(html.EscapeString(string(n.(*commentInline).text)))
+		w.WriteString("</span>")
+	}
+	return ast.WalkContinue, nil
+}
+
+type commentsExtension struct{}
+
+func (e *commentsExtension) Extend(m goldmark.Markdown) {
+	m.Parser().AddOptions(parser.WithASTTransformers(util.Prioritized(&commentsTransformer{}, 100)))
+	m.Renderer().AddOptions(renderer.WithNodeRenderers(util.Prioritized(&commentsRenderer{}, 100)))
+}
@@ -0,0 +1,337 @@
+// Package render converts markdown and Gemtext to HTML, as shown by mdvy.
+package render
+
+import (
+	"bytes"
+	_ "embed"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/yuin/goldmark"
+	meta "github.com/yuin/goldmark-meta"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/extension"
+	extast "github.com/yuin/goldmark/extension/ast"
+	"github.com/yuin/goldmark/parser"
+	"github.com/yuin/goldmark/renderer"
+	"github.com/yuin/goldmark/renderer/html"
+	"github.com/yuin/goldmark/text"
+)
+
+// Conversion options
+type Options struct {
+	Format       string // FormatMarkdown or FormatGemtext, or "" to detect
+	NoMath       bool   // Don't render $...$ and $$...$$ as math
+	Safe         bool   // Drop raw HTML from markdown
+	Inline       bool   // Format inline markup in Gemtext
+	Linkify      bool   // Link bare URLs in Gemtext
+	OrderedLists bool   // Parse numbered Gemtext lines as ordered lists
+	MergeLines   bool   // Join consecutive Gemtext text lines into a paragraph
+	InlineImages bool   // Show Gemtext links to images as images
+	ShowComments bool   // Show HTML comments in markdown as annotations
+	Encoding     string // Input encoding (see Encodings), or "" to detect
+}
+
+// Converts markdown or Gemtext source to HTML.
+// For Gemtext, the previous parse is kept to mark changed blocks.
+type Converter struct {
+	md   goldmark.Markdown
+	gt   Gemtext
+	opts Options
+
+	// Image destinations referenced by the last converted document
+	images []string
+	// Title from the frontmatter or the first heading of the last converted
+	// document
+	title string
+	// Number of words in the last converted document
+	words int
+}
+
+// Links bare URLs (GFM autolinks), including gemini:// ones.
+// Trailing punctuation (e.g. the period in "See https://example.com.") is
+// not part of the link.
+var autolinks = extension.NewLinkify(
+	extension.WithLinkifyAllowedProtocols([][]byte{[]byte("http:"), []byte("https:"), []byte("ftp:"), []byte("gemini:")}),
+	extension.WithLinkifyURLRegexp(regexp.MustCompile(`^(?:http|https|ftp|gemini)://[-a-zA-Z0-9@:%._\+~#=]{1,256}\.[a-z]+(?::\d+)?(?:[/#?][-a-zA-Z0-9@:%_+.~#$!?&/=\(\);,'">\^{}\[\]`+"`"+`]*)?`)),
+)
+
+func NewConverter(format string, opts Options) *Converter {
+	var md goldmark.Markdown
+	if format != FormatGemtext {
+		extensions := []goldmark.Extender{
+			extension.Table, extension.Strikethrough, extension.TaskList, autolinks,
+			extension.Footnote, extension.DefinitionList, extension.Typographer,
+			meta.Meta, Mermaid, Emoji, SourceLines, Figures, TaskIndexes,
+		}
+		if !opts.NoMath {
+			extensions = append(extensions, Math)
+		}
+		if opts.ShowComments {
+			extensions = append(extensions, Comments)
+		}
+		var rendererOptions []renderer.Option
+		if !opts.Safe {
+			rendererOptions = append(rendererOptions, html.WithUnsafe())
+		}
+		md = goldmark.New(
+			goldmark.WithExtensions(extensions...),
+			goldmark.WithParserOptions(
+				parser.WithAutoHeadingID(),
+			),
+			goldmark.WithRendererOptions(rendererOptions...),
+		)
+	}
+	return &Converter{md: md, opts: opts}
+}
+
+// Title from the frontmatter or the first heading of the last converted
+// document, if any
+func (c *Converter) Title() string {
+	return c.title
+}
+
+// Image destinations referenced by the last converted document
+func (c *Converter) Images() []string {
+	return c.images
+}
+
+// Number of words in the last converted document
+func (c *Converter) Words() int {
+	return c.words
+}
+
+// The input is decoded according to the Encoding option.
+func (c *Converter) Convert(r io.Reader, w io.Writer) error {
+	input, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if input, err = Decode(input, c.opts.Encoding); err != nil {
+		return err
+	}
+	if c.md != nil {
+		ctx := parser.NewContext()
+		doc := c.md.Parser().Parse(text.NewReader(input), parser.WithContext(ctx))
+		title, _ := meta.Get(ctx)["title"].(string)
+		var images []string
+		var words strings.Builder
+		ast.Walk(doc, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+			switch n := n.(type) {
+			case *ast.Heading:
+				if entering && title == "" {
+					title = string(n.Text(input))
+				}
+			case *ast.Image:
+				if entering {
+					images = append(images, string(n.Destination))
+				}
+			case *ast.Text:
+				if entering {
+					words.Write(n.Segment.Value(input))
+					if n.SoftLineBreak() || n.HardLineBreak() {
+						words.WriteByte(' ')
+					}
+				}
+			case *ast.String:
+				if entering {
+					words.Write(n.Value)
+				}
+			}
+			if !entering && n.Type() == ast.TypeBlock {
+				words.WriteByte(' ')
+			}
+			return ast.WalkContinue, nil
+		})
+		c.title = title
+		c.images = images
+		c.words = len(strings.Fields(words.String()))
+		return c.md.Renderer().Render(w, input, doc)
+	}
+	gt, err := ParseGemtext(bytes.NewReader(input), c.opts)
+	if err != nil {
+		return err
+	}
+	if err := GemtextToHTML(gt, c.gt, c.opts, w); err != nil {
+		return err
+	}
+	c.gt = gt
+	c.images = nil
+	if c.opts.InlineImages {
+		c.images = gt.Images()
+	}
+	c.title = ""
+	for _, n := range gt {
+		if h, ok := n.(*Heading); ok {
+			c.title = h.Text
+			break
+		}
+	}
+	c.words = gt.Words()
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// Formats
+////////////////////////////////////////////////////////////////////////////////
+
+const (
+	FormatMarkdown = "md"
+	FormatGemtext  = "gemtext"
+)
+
+// Recognized file extensions, with their format
+var formatExtensions = map[string]string{
+	".gmi":      FormatGemtext,
+	".gemini":   FormatGemtext,
+	".md":       FormatMarkdown,
+	".markdown": FormatMarkdown,
+	".mdown":    FormatMarkdown,
+	".mkd":      FormatMarkdown,
+	".mkdn":     FormatMarkdown,
+	".mdwn":     FormatMarkdown,
+}
+
+// Returns the format of a file by its extension, or "" for unknown extensions.
+func FormatFromExtension(source string) string {
+	return formatExtensions[strings.ToLower(filepath.Ext(source))]
+}
+
+var markdownOnlyRE = regexp.MustCompile(`(?m)^\s*([-+] |\d+[.)] )|\[[^\]]*\]\([^)]*\)|\*\*|__`)
+var gemtextLinkRE = regexp.MustCompile(`(?m)^=>\s*\S`)
+
+// Guesses the format from the content. Gemtext link lines without any
+// markdown-only syntax (inline links, emphasis, '-' or numbered lists) mean
+// Gemtext.
+func SniffFormat(input []byte) string {
+	if gemtextLinkRE.Match(input) && !markdownOnlyRE.Match(input) {
+		return FormatGemtext
+	}
+	return FormatMarkdown
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// Task lists
+////////////////////////////////////////////////////////////////////////////////
+
+// Returns the offsets of the check marks of the task list items in a markdown
+// document, in document order (as numbered by TaskIndexes). The offset is -1
+// if the check mark can't be found.
+func (c *Converter) taskOffsets(input []byte) []int {
+	var offsets []int
+	doc := c.md.Parser().Parse(text.NewReader(input))
+	ast.Walk(doc, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		if _, ok := n.(*extast.TaskCheckBox); ok && entering {
+			// The check box is always at the start of the list item's first line
+			offset := -1
+			if lines := n.Parent().Lines(); lines.Len() > 0 {
+				if o := lines.At(0).Start + 1; o < len(input) && input[o-1] == '[' {
+					offset = o
+				}
+			}
+			offsets = append(offsets, offset)
+		}
+		return ast.WalkContinue, nil
+	})
+	return offsets
+}
+
+// Checks or unchecks the index'th task list item of a markdown file.
+func (c *Converter) SetTask(source string, index int, checked bool) error {
+	if c.md == nil {
+		return errors.New("task lists can only be edited in markdown files")
+	}
+	info, err := os.Stat(source)
+	if err != nil {
+		return err
+	}
+	input, err := os.ReadFile(source)
+	if err != nil {
+		return err
+	}
+	encoding := c.opts.Encoding
+	if encoding == "" {
+		encoding = DetectEncoding(input)
+	}
+	if encoding != EncodingUTF8 {
+		return errors.New("task lists can only be edited in UTF-8 files")
+	}
+	// Offsets are in the source as converted, without byte order mark
+	body := bytes.TrimPrefix(input, byteOrderMarks[EncodingUTF8])
+	offsets := c.taskOffsets(body)
+	if index < 0 || index >= len(offsets) || offsets[index] < 0 {
+		return fmt.Errorf("task %d not found", index)
+	}
+	if checked {
+		body[offsets[index]] = 'x'
+	} else {
+		body[offsets[index]] = ' '
+	}
+	return os.WriteFile(source, input, info.Mode())
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// Documents
+////////////////////////////////////////////////////////////////////////////////
+
+// The built-in stylesheet
+//
+//go:embed style.css
+var Style string
+
+var documentTmpl = template.Must(template.New("document").Parse(`<!DOCTYPE html>
+<html>
+<head>
+	<meta charset="utf-8">
+	<title>{{.Title}}</title>
+	<style>{{.Style}}</style>
+	{{with .UserStyle}}<style>{{.}}</style>{{end}}
+</head>
+<body>
+	<div id="content">{{.Content}}</div>
+</body>
+</html>
+`))
+
+// Writes converted content as a standalone HTML document, with the built-in
+// style and an optional user stylesheet.
+func WriteDocument(w io.Writer, title string, content string, userStyle string) error {
+	return documentTmpl.Execute(w, struct {
+		Title     string
+		Style     template.CSS
+		UserStyle template.CSS
+		Content   template.HTML
+	}{Title: title, Style: template.CSS(Style), UserStyle: template.CSS(userStyle), Content: template.HTML(content)})
+}
+
+// Converts markdown or Gemtext source to a standalone HTML document.
+func Render(source io.Reader, opts Options) ([]byte, error) {
+	input, err := io.ReadAll(source)
+	if err != nil {
+		return nil, err
+	}
+	if input, err = Decode(input, opts.Encoding); err != nil {
+		return nil, err
+	}
+	opts.Encoding = EncodingUTF8
+	format := opts.Format
+	if format == "" {
+		format = SniffFormat(input)
+	}
+	c := NewConverter(format, opts)
+	var content bytes.Buffer
+	if err := c.Convert(bytes.NewReader(input), &content); err != nil {
+		return nil, err
+	}
+	var out bytes.Buffer
+	if err := WriteDocument(&out, c.Title(), content.String(), ""); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
@@ -0,0 +1,504 @@
+package render
+
+import (
+	"html"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func convert(t *testing.T, input string, format string, opts Options) string {
+	t.Helper()
+	var out strings.Builder
+	if err := NewConverter(format, opts).Convert(strings.NewReader(input), &out); err != nil {
+		t.Fatal(err)
+	}
+	return out.String()
+}
+
+func convertFile(t *testing.T, name string, opts Options) string {
+	t.Helper()
+	input, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return convert(t, string(input), FormatFromExtension(name), opts)
+}
+
+func TestComments(t *testing.T) {
+	tests := []struct {
+		input string
+		opts  Options
+		want  string
+	}{
+		{"<!-- TODO <b> -->\n\ntext", Options{}, "<!-- TODO <b> -->\n"},
+		{"<!-- TODO <b> -->\n\ntext", Options{ShowComments: true}, `<aside class="comment" data-line="1">TODO &lt;b&gt;</aside>`},
+		{"<!-- TODO <b> -->\n\ntext", Options{ShowComments: true, Safe: true}, `<aside class="comment" data-line="1">TODO &lt;b&gt;</aside>`},
+		{"<!--\nmulti\nline\n-->", Options{ShowComments: true}, `<aside class="comment" data-line="1">multi` + "\n" + `line</aside>`},
+		{"a <!-- note --> b", Options{}, `<p data-line="1">a <!-- note --> b</p>`},
+		{"a <!-- note --> b", Options{ShowComments: true}, `<p data-line="1">a <span class="comment">note</span> b</p>`},
+		{"a <!-- note --> b", Options{ShowComments: true, Safe: true}, `<p data-line="1">a <span class="comment">note</span> b</p>`},
+		{"* item <!-- x -->", Options{ShowComments: true}, `<li data-line="1">item <span class="comment">x</span></li>`},
+		{"> <!-- q -->", Options{ShowComments: true}, `<blockquote data-line="1"><aside class="comment" data-line="1">q</aside>`},
+	}
+	for _, test := range tests {
+		got := convert(t, test.input, FormatMarkdown, test.opts)
+		if !strings.Contains(got, test.want) {
+			t.Errorf("%q %+v: got %q, want it to contain %q", test.input, test.opts, got, test.want)
+		}
+		if !test.opts.ShowComments && strings.Contains(got, `class="comment"`) {
+			t.Errorf("%q: got %q, want comments hidden", test.input, got)
+		}
+	}
+}
+
+func TestTitle(t *testing.T) {
+	tests := []struct {
+		input  string
+		format string
+		want   string
+	}{
+		{"---\ntitle: From frontmatter\n---\n# From heading\n", FormatMarkdown, "From frontmatter"},
+		{"---\ndate: 2024-01-01\n---\n# From heading\n", FormatMarkdown, "From heading"},
+		{"---\ntitle: \"\"\n---\n## Second level\n", FormatMarkdown, "Second level"},
+		{"text\n\n## *Emphasized* heading\n\n# Later\n", FormatMarkdown, "Emphasized heading"},
+		{"no heading\n", FormatMarkdown, ""},
+		{"text\n## Gemtext heading\n# Later\n", FormatGemtext, "Gemtext heading"},
+	}
+	for _, test := range tests {
+		c := NewConverter(test.format, Options{})
+		var out strings.Builder
+		if err := c.Convert(strings.NewReader(test.input), &out); err != nil {
+			t.Fatal(err)
+		}
+		if got := c.Title(); got != test.want {
+			t.Errorf("%q: got title %q, want %q", test.input, got, test.want)
+		}
+		if strings.Contains(out.String(), "title:") || strings.Contains(out.String(), "<hr") {
+			t.Errorf("%q: got frontmatter in %q", test.input, out.String())
+		}
+	}
+}
+
+func TestHeadingIDs(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"## My Section", `<h2 id="my-section" data-line="1">My Section</h2>`},
+		{"# Hello, *World*!", `<h1 id="hello-world" data-line="1">`},
+		{"# A\n\n# A", `<h1 id="a-1" data-line="3">`},
+		{"[jump](#my-section)\n\n## My Section", `<a href="#my-section">jump</a>`},
+	}
+	for _, test := range tests {
+		if got := convert(t, test.input, FormatMarkdown, Options{}); !strings.Contains(got, test.want) {
+			t.Errorf("%q: got %q, want it to contain %q", test.input, got, test.want)
+		}
+	}
+}
+
+func TestFootnotes(t *testing.T) {
+	got := convertFile(t, "footnotes.md", Options{})
+	counts := []struct {
+		s    string
+		want int
+	}{
+		{`class="footnote-ref"`, 4},
+		{`<li id="fn:`, 3},
+		{`class="footnote-backref"`, 4},
+		{`<a href="#fnref1:3" class="footnote-backref"`, 1},
+		{`<div class="footnotes" role="doc-endnotes" data-line="8">`, 1},
+	}
+	for _, c := range counts {
+		if n := strings.Count(got, c.s); n != c.want {
+			t.Errorf("got %d times %q, want %d", n, c.s, c.want)
+		}
+	}
+}
+
+func TestDefinitionLists(t *testing.T) {
+	got := convertFile(t, "definitions.md", Options{})
+	counts := []struct {
+		s    string
+		want int
+	}{
+		{`<dl data-line="3">`, 1},
+		{`<dt `, 3},
+		{`<dd `, 4},
+		{`<dt data-line="10">Term with <em>emphasis</em></dt>`, 1},
+		{`<dd data-line="12">` + "\n" + `<p data-line="12">`, 1},
+	}
+	for _, c := range counts {
+		if n := strings.Count(got, c.s); n != c.want {
+			t.Errorf("got %d times %q, want %d", n, c.s, c.want)
+		}
+	}
+}
+
+func TestEmoji(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"Hello :smile:", "Hello 😄"},
+		{":+1: and :tada:", "👍 and 🎉"},
+		{":rocket::rocket:", "🚀🚀"},
+		{"Unknown :not_an_emoji:", "Unknown :not_an_emoji:"},
+		{"In code `:smile:`", "<code>:smile:</code>"},
+		{"Time 10:30:00", "Time 10:30:00"},
+		// Not inside words
+		{"1:100:", "1:100:"},
+		{"a:smile: b", "a:smile: b"},
+		{"(:smile:)", "(😄)"},
+	}
+	for _, test := range tests {
+		// Emoji may be written as characters or as character references
+		got := html.UnescapeString(convert(t, test.input, FormatMarkdown, Options{}))
+		if !strings.Contains(got, test.want) {
+			t.Errorf("%q: got %q, want it to contain %q", test.input, got, test.want)
+		}
+	}
+}
+
+func TestTables(t *testing.T) {
+	got := convertFile(t, "tables.md", Options{})
+	counts := []struct {
+		s    string
+		want int
+	}{
+		{`<table data-line="`, 2},
+		{`<th `, 14},
+		{`<tr data-line="`, 3},
+		{`<th data-line="3" style="text-align:left">Left</th>`, 1},
+		{`<td data-line="5" style="text-align:center">b</td>`, 1},
+		{`<td data-line="6" style="text-align:right">1 | 2</td>`, 1},
+		{`<td data-line="6" style="text-align:left"><code>code</code></td>`, 1},
+	}
+	for _, c := range counts {
+		if n := strings.Count(got, c.s); n != c.want {
+			t.Errorf("got %d times %q, want %d", n, c.s, c.want)
+		}
+	}
+}
+
+func TestNestedLists(t *testing.T) {
+	got := convertFile(t, "lists.md", Options{})
+	for _, want := range []string{
+		`<li data-line="3">One` + "\n" + `<ul data-line="4">` + "\n" + `<li data-line="4">Two` + "\n" + `<ul data-line="5">` + "\n" + `<li data-line="5">Three</li>`,
+		`<li data-line="7">Two again</li>` + "\n" + `</ul>` + "\n" + `</li>` + "\n" + `<li data-line="8">One again</li>`,
+		`<ol data-line="11">` + "\n" + `<li data-line="11">Second` + "\n" + `<ul data-line="12">` + "\n" + `<li data-line="12">Third</li>`,
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("got %q, want it to contain %q", got, want)
+		}
+	}
+	if n := strings.Count(got, "<ul"); n != 4 {
+		t.Errorf("got %d unordered lists, want 4", n)
+	}
+}
+
+func TestMath(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"$x^2$", `<p data-line="1"><span class="math inline">x^2</span></p>`},
+		{"a $x < y$ b", `a <span class="math inline">x &lt; y</span> b`},
+		{"$$\\sum_i x_i$$", `<span class="math display">\sum_i x_i</span>`},
+		{"$a$ $$b$$ $c$", `<span class="math inline">a</span> <span class="math display">b</span> <span class="math inline">c</span>`},
+		{"$x*y*z$", `<span class="math inline">x*y*z</span>`},
+		{"$a\\$b$", `<span class="math inline">a\$b</span>`},
+		{"$$\n\\int f\n$$\n\ntext", `<div class="math display">\int f` + "\n" + `</div>` + "\n" + `<p data-line="5">text</p>`},
+		// The closing fence is the last line, without newline
+		{"$$\n\\int f\n$$", `<div class="math display">\int f` + "\n" + `</div>` + "\n"},
+		{"$$\nx", `<div class="math display">x</div>`},
+		{"> $$\n> a\n> $$", `<div class="math display">a` + "\n" + `</div>` + "\n" + `</blockquote>`},
+		// Not math
+		{"$5 and $6", `<p data-line="1">$5 and $6</p>`},
+		{"costs $5.", `<p data-line="1">costs $5.</p>`},
+		{"$ x$", `<p data-line="1">$ x$</p>`},
+		{"$x $", `<p data-line="1">$x $</p>`},
+		{"$x$5", `<p data-line="1">$x$5</p>`},
+		{"$$x", `<p data-line="1">$$x</p>`},
+		{"\\$x$", `<p data-line="1">$x$</p>`},
+		{"`$x$`", `<p data-line="1"><code>$x$</code></p>`},
+	}
+	for _, test := range tests {
+		if got := convert(t, test.input, FormatMarkdown, Options{}); !strings.Contains(got, test.want) {
+			t.Errorf("%q: got %q, want it to contain %q", test.input, got, test.want)
+		}
+		if got := convert(t, test.input, FormatMarkdown, Options{NoMath: true}); strings.Contains(got, `class="math`) {
+			t.Errorf("%q: got %q with -no-math", test.input, got)
+		}
+	}
+	if got, want := convert(t, "$x*y*z$", FormatMarkdown, Options{NoMath: true}), `$x<em>y</em>z$`; !strings.Contains(got, want) {
+		t.Errorf("got %q with -no-math, want it to contain %q", got, want)
+	}
+
+	// Unclosed math isn't scanned for again from every $ on the line
+	input := strings.Repeat("$a ", 100000)
+	start := time.Now()
+	got := convert(t, input, FormatMarkdown, Options{})
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("took %v", elapsed)
+	}
+	if strings.Contains(got, `class="math`) {
+		t.Errorf("got math in %q", got[:60])
+	}
+}
+
+func TestMermaid(t *testing.T) {
+	got := convertFile(t, "flowchart.md", Options{})
+	want := `<div class="mermaid">flowchart LR
+    A[Save the file] --&gt; B{Changed?}
+    B --&gt;|yes| C[Render]
+    B --&gt;|no| D[Skip]
+    C --&gt; E[&#34;Show &lt;em&gt;new&lt;/em&gt; content&#34;]
+</div>`
+	if !strings.Contains(got, want) {
+		t.Errorf("got %q, want it to contain %q", got, want)
+	}
+	if n := strings.Count(got, `class="mermaid"`); n != 1 {
+		t.Errorf("got %d diagrams, want 1", n)
+	}
+	if !strings.Contains(got, `<code class="language-go">`) {
+		t.Errorf("got %q, want other code blocks kept", got)
+	}
+}
+
+func TestFigures(t *testing.T) {
+	got := convertFile(t, "figures.md", Options{})
+	for _, want := range []string{
+		`<figure class="image" data-line="3"><img src="d.png" alt="A diagram" title="The title"><figcaption>The title</figcaption></figure>`,
+		`<p data-line="5"><img src="plain.png" alt="No title"></p>`,
+		`<p data-line="7">Text with <img src="inline.png" alt="an image" title="Inline"> in it.</p>`,
+		`<figcaption>A &#34;quoted&#34; &amp; &lt;b&gt;</figcaption>`,
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("got %q, want it to contain %q", got, want)
+		}
+	}
+	if n := strings.Count(got, "<figure"); n != 2 {
+		t.Errorf("got %d figures, want 2", n)
+	}
+}
+
+func TestMarkdownToGemtext(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"# One\n\n#### Four", "# One\n\n### Four\n"},
+		{"Some *emphasis*, **strong** and `code`.", "Some emphasis, strong and code.\n"},
+		{"See [the docs](https://example.com) and https://example.org.", "See the docs and https://example.org.\n=> https://example.com the docs\n=> https://example.org\n"},
+		{"- a\n- b\n  - nested", "* a\n* b\n* nested\n"},
+		{"3. a\n4. b", "3. a\n4. b\n"},
+		{"- [x] done\n- [ ] todo", "* [x] done\n* [ ] todo\n"},
+		{"> quote\n>\n> more", "> quote\n>\n> more\n"},
+		{"```go\nx := 1\n```", "```go\nx := 1\n```\n"},
+		{"    indented", "```\nindented\n```\n"},
+		{"a\n\n---", "a\n\n---\n"},
+		{"| a | b |\n|---|---|\n| 1 | 2 |", "```\na | b\n1 | 2\n```\n"},
+		{"<div>html</div>\n\ntext <b>x</b>", "text x\n"},
+		// Text that would be Gemtext markup
+		{"\\# not a heading\n\n\\* not a list", " # not a heading\n\n * not a list\n"},
+		{"=> not a link", " => not a link\n"},
+		{"a &amp; b &#35; \\*c\\* `\\*code\\*`", "a & b # *c* \\*code\\*\n"},
+		{"![alt](d.png \"The title\")", "=> d.png The title\n"},
+		{"![alt](d.png)", "alt\n=> d.png alt\n"},
+	}
+	for _, test := range tests {
+		var out strings.Builder
+		if err := MarkdownToGemtext([]byte(test.input), Options{}, &out); err != nil {
+			t.Fatal(err)
+		}
+		if out.String() != test.want {
+			t.Errorf("%q: got %q, want %q", test.input, out.String(), test.want)
+		}
+	}
+
+	input, err := os.ReadFile(filepath.Join("testdata", "figures.md"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out strings.Builder
+	if err := MarkdownToGemtext(input, Options{}, &out); err != nil {
+		t.Fatal(err)
+	}
+	want := "# Figures\n\n=> d.png The title\n\nNo title\n=> plain.png No title\n\n" +
+		"Text with an image in it.\n=> inline.png an image\n\n=> e.png A \"quoted\" & <b>\n"
+	if out.String() != want {
+		t.Errorf("figures.md: got %q, want %q", out.String(), want)
+	}
+}
+
+func TestFormatFromExtension(t *testing.T) {
+	tests := []struct {
+		source string
+		want   string
+	}{
+		{"a.md", FormatMarkdown},
+		{"a.markdown", FormatMarkdown},
+		{"a.mdown", FormatMarkdown},
+		{"a.mkd", FormatMarkdown},
+		{"a.mkdn", FormatMarkdown},
+		{"a.mdwn", FormatMarkdown},
+		{"dir/A.MD", FormatMarkdown},
+		{"a.gmi", FormatGemtext},
+		{"a.gemini", FormatGemtext},
+		{"a.GMI", FormatGemtext},
+		{"a.txt", ""},
+		{"README", ""},
+		{"a.md.txt", ""},
+		{"md", ""},
+	}
+	for _, test := range tests {
+		if got := FormatFromExtension(test.source); got != test.want {
+			t.Errorf("%s: got %q, want %q", test.source, got, test.want)
+		}
+	}
+}
+
+func TestSniffFormat(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"# Title\n\n=> gemini://example.com Link\n* item", FormatGemtext},
+		{"=>url", FormatGemtext},
+		{"# Title\n\ntext", FormatMarkdown},
+		{"", FormatMarkdown},
+		// Markdown-only syntax wins
+		{"=> url\n- item", FormatMarkdown},
+		{"=> url\n1. item", FormatMarkdown},
+		{"=> url\n[link](url)", FormatMarkdown},
+		{"=> url\n**bold**", FormatMarkdown},
+		{"=> url\n__bold__", FormatMarkdown},
+		{"text => url", FormatMarkdown},
+		{"=>", FormatMarkdown},
+	}
+	for _, test := range tests {
+		if got := SniffFormat([]byte(test.input)); got != test.want {
+			t.Errorf("%q: got %q, want %q", test.input, got, test.want)
+		}
+	}
+}
+
+func TestSetTask(t *testing.T) {
+	tests := []struct {
+		input   string
+		index   int
+		checked bool
+		want    string
+	}{
+		{"- [ ] a\n- [ ] b\n", 1, true, "- [ ] a\n- [x] b\n"},
+		{"- [x] a\n", 0, false, "- [ ] a\n"},
+		{"- [X] a\n", 0, false, "- [ ] a\n"},
+		{"1. [ ] a\n   * [ ] nested\n", 1, true, "1. [ ] a\n   * [x] nested\n"},
+		{"> - [ ] quoted\n", 0, true, "> - [x] quoted\n"},
+		// Check boxes in code are not tasks
+		{"```\n- [ ] code\n```\n- [ ] a\n", 0, true, "```\n- [ ] code\n```\n- [x] a\n"},
+		{"\ufeff- [ ] bom\n", 0, true, "\ufeff- [x] bom\n"},
+		// Loose list items have their check box in a paragraph
+		{"- [ ] a\n\n- [ ] b\n\n- [ ] c\n", 1, true, "- [ ] a\n\n- [x] b\n\n- [ ] c\n"},
+		{"- [ ] tight\n\n<input type=checkbox>\n\n- [ ] loose\n\n  more\n- [ ] c\n", 2, true,
+			"- [ ] tight\n\n<input type=checkbox>\n\n- [ ] loose\n\n  more\n- [x] c\n"},
+	}
+	for _, test := range tests {
+		source := filepath.Join(t.TempDir(), "tasks.md")
+		if err := os.WriteFile(source, []byte(test.input), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := NewConverter(FormatMarkdown, Options{}).SetTask(source, test.index, test.checked); err != nil {
+			t.Errorf("%q: %v", test.input, err)
+			continue
+		}
+		if got, _ := os.ReadFile(source); string(got) != test.want {
+			t.Errorf("%q: got %q, want %q", test.input, got, test.want)
+		}
+	}
+
+	// The viewer sends the index of the box that is rendered
+	input := "- [ ] a\n\n- [ ] b\n\n<input type=checkbox>\n\n* x\n\n  - [x] c\n"
+	got := convert(t, input, FormatMarkdown, Options{})
+	for i, want := range []string{
+		`<p data-line="1"><input disabled="" type="checkbox" data-task="0"> a</p>`,
+		`<p data-line="3"><input disabled="" type="checkbox" data-task="1"> b</p>`,
+		`<input checked="" disabled="" type="checkbox" data-task="2"> c`,
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("task %d: got %q, want it to contain %q", i, got, want)
+		}
+	}
+	if n := strings.Count(got, "data-task="); n != 3 {
+		t.Errorf("got %d task indexes, want 3", n)
+	}
+
+	failures := []struct {
+		input  string
+		format string
+		opts   Options
+		index  int
+	}{
+		{"- [ ] a\n", FormatMarkdown, Options{}, 1},
+		{"- [ ] a\n", FormatMarkdown, Options{}, -1},
+		{"* [ ] a\n", FormatGemtext, Options{}, 0},
+		{"- [ ] a\n", FormatMarkdown, Options{Encoding: EncodingLatin1}, 0},
+		{"\xff\xfe-\x00 \x00[\x00 \x00]\x00", FormatMarkdown, Options{}, 0},
+	}
+	for _, test := range failures {
+		source := filepath.Join(t.TempDir(), "tasks.md")
+		if err := os.WriteFile(source, []byte(test.input), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := NewConverter(test.format, test.opts).SetTask(source, test.index, true); err == nil {
+			t.Errorf("%q: got no error", test.input)
+		}
+		if got, _ := os.ReadFile(source); string(got) != test.input {
+			t.Errorf("%q: got %q, want it unchanged", test.input, got)
+		}
+	}
+}
+
+func TestSafe(t *testing.T) {
+	tests := []struct {
+		input string
+		safe  bool
+		want  string
+	}{
+		{"<script>alert(1)</script>", false, "<script>alert(1)</script>"},
+		{"<script>alert(1)</script>", true, "<!-- raw HTML omitted -->"},
+		{"a <b>bold</b>", false, "a <b>bold</b>"},
+		{"a <b>bold</b>", true, "a <!-- raw HTML omitted -->bold<!-- raw HTML omitted -->"},
+	}
+	for _, test := range tests {
+		got := convert(t, test.input, FormatMarkdown, Options{Safe: test.safe})
+		if !strings.Contains(got, test.want) {
+			t.Errorf("%q (safe %v): got %q, want it to contain %q", test.input, test.safe, got, test.want)
+		}
+		if test.safe && strings.Contains(got, "<script") {
+			t.Errorf("%q: got %q with script in safe mode", test.input, got)
+		}
+	}
+}
+
+func TestAutolinks(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"See https://example.com.", `<p data-line="1">See <a href="https://example.com">https://example.com</a>.</p>`},
+		{"(https://example.com/a_(b))", `<a href="https://example.com/a_(b)">`},
+		{"https://example.com/x?y=1, then", `<a href="https://example.com/x?y=1">https://example.com/x?y=1</a>, then`},
+		{"gemini://example.com!", `<a href="gemini://example.com">gemini://example.com</a>!`},
+		{"ftp://example.com", `<a href="ftp://example.com">`},
+		{"file:///etc/passwd", `<p data-line="1">file:///etc/passwd</p>`},
+	}
+	for _, test := range tests {
+		if got := convert(t, test.input, FormatMarkdown, Options{}); !strings.Contains(got, test.want) {
+			t.Errorf("%q: got %q, want it to contain %q", test.input, got, test.want)
+		}
+	}
+}
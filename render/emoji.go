@@ -0,0 +1,42 @@
+package render
+
+import (
+	"github.com/yuin/goldmark"
+	emoji "github.com/yuin/goldmark-emoji"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/parser"
+	"github.com/yuin/goldmark/text"
+	"github.com/yuin/goldmark/util"
+)
+
+// Goldmark extension that replaces :shortcode: emoji (GitHub names) by the
+// unicode emoji. Unknown shortcodes are left alone.
+var Emoji = &emojiExtension{}
+
+type emojiExtension struct{}
+
+func (e *emojiExtension) Extend(m goldmark.Markdown) {
+	emoji.New(emoji.WithRenderingMethod(emoji.Unicode)).Extend(m)
+	m.Parser().AddOptions(parser.WithInlineParsers(
+		// Before the emoji parser (999)
+		util.Prioritized(&wordColonParser{}, 998),
+	))
+}
+
+// Keeps a colon right after a letter or digit as text, so it doesn't start a
+// shortcode (like the ":100:" in "1:100:")
+type wordColonParser struct{}
+
+func (p *wordColonParser) Trigger() []byte {
+	return []byte{':'}
+}
+
+func (p *wordColonParser) Parse(parent ast.Node, block text.Reader, pc parser.Context) ast.Node {
+	c := block.PrecendingCharacter()
+	if c >= 0x80 || !util.IsAlphaNumeric(byte(c)) {
+		return nil
+	}
+	_, segment := block.PeekLine()
+	block.Advance(1)
+	return ast.NewTextSegment(segment.WithStop(segment.Start + 1))
+}
@@ -0,0 +1,70 @@
+package render
+
+import (
+	"bytes"
+	"fmt"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// Input encodings
+const (
+	EncodingUTF8    = "utf-8"
+	EncodingUTF16LE = "utf-16le"
+	EncodingUTF16BE = "utf-16be"
+	EncodingLatin1  = "latin-1"
+)
+
+var Encodings = []string{EncodingUTF8, EncodingUTF16LE, EncodingUTF16BE, EncodingLatin1}
+
+var byteOrderMarks = map[string][]byte{
+	EncodingUTF8:    {0xef, 0xbb, 0xbf},
+	EncodingUTF16LE: {0xff, 0xfe},
+	EncodingUTF16BE: {0xfe, 0xff},
+}
+
+// Returns the encoding of input from its byte order mark, or UTF-8 if it has
+// none.
+func DetectEncoding(input []byte) string {
+	for _, encoding := range []string{EncodingUTF8, EncodingUTF16LE, EncodingUTF16BE} {
+		if bytes.HasPrefix(input, byteOrderMarks[encoding]) {
+			return encoding
+		}
+	}
+	return EncodingUTF8
+}
+
+// Converts input to UTF-8, without byte order mark. An empty encoding is
+// detected with DetectEncoding.
+func Decode(input []byte, encoding string) ([]byte, error) {
+	if encoding == "" {
+		encoding = DetectEncoding(input)
+	}
+	input = bytes.TrimPrefix(input, byteOrderMarks[encoding])
+	switch encoding {
+	case EncodingUTF8:
+		return input, nil
+	case EncodingUTF16LE, EncodingUTF16BE:
+		units := make([]uint16, len(input)/2)
+		for i := range units {
+			if encoding == EncodingUTF16LE {
+				units[i] = uint16(input[2*i]) | uint16(input[2*i+1])<<8
+			} else {
+				units[i] = uint16(input[2*i])<<8 | uint16(input[2*i+1])
+			}
+		}
+		runes := utf16.Decode(units)
+		if len(input)%2 != 0 {
+			runes = append(runes, utf8.RuneError)
+		}
+		return []byte(string(runes)), nil
+	case EncodingLatin1:
+		out := make([]byte, 0, len(input))
+		for _, b := range input {
+			out = utf8.AppendRune(out, rune(b))
+		}
+		return out, nil
+	default:
+		return nil, fmt.Errorf("unknown encoding: %s", encoding)
+	}
+}
@@ -0,0 +1,83 @@
+package render
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf16"
+)
+
+func encodeUTF16(s string, bigEndian bool) []byte {
+	var out []byte
+	for _, u := range utf16.Encode([]rune(s)) {
+		if bigEndian {
+			out = append(out, byte(u>>8), byte(u))
+		} else {
+			out = append(out, byte(u), byte(u>>8))
+		}
+	}
+	return out
+}
+
+func TestDetectEncoding(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"", EncodingUTF8},
+		{"# a", EncodingUTF8},
+		{"\xef\xbb\xbf# a", EncodingUTF8},
+		{"\xff\xfe#\x00", EncodingUTF16LE},
+		{"\xfe\xff\x00#", EncodingUTF16BE},
+		{"\xe9t\xe9", EncodingUTF8},
+	}
+	for _, test := range tests {
+		if got := DetectEncoding([]byte(test.input)); got != test.want {
+			t.Errorf("%q: got %s, want %s", test.input, got, test.want)
+		}
+	}
+}
+
+func TestDecode(t *testing.T) {
+	text := "# Café 😀\n"
+	tests := []struct {
+		name     string
+		input    []byte
+		encoding string
+		want     string
+	}{
+		{"utf-8", []byte(text), "", text},
+		{"utf-8 bom", append([]byte("\xef\xbb\xbf"), text...), "", text},
+		{"utf-16le bom", append([]byte("\xff\xfe"), encodeUTF16(text, false)...), "", text},
+		{"utf-16be bom", append([]byte("\xfe\xff"), encodeUTF16(text, true)...), "", text},
+		{"forced utf-16le", encodeUTF16(text, false), EncodingUTF16LE, text},
+		{"forced utf-16be", encodeUTF16(text, true), EncodingUTF16BE, text},
+		{"odd length", append(encodeUTF16("a", false), 'b'), EncodingUTF16LE, "a�"},
+		{"latin-1", []byte("caf\xe9 \xa9"), EncodingLatin1, "café ©"},
+		// A forced encoding doesn't strip another encoding's mark
+		{"latin-1 bom", []byte("\xff\xfea"), EncodingLatin1, "ÿþa"},
+	}
+	for _, test := range tests {
+		got, err := Decode(test.input, test.encoding)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if string(got) != test.want {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+	}
+
+	if _, err := Decode([]byte("a"), "ebcdic"); err == nil {
+		t.Errorf("got no error for unknown encoding")
+	}
+}
+
+func TestConvertUTF16(t *testing.T) {
+	for _, format := range []string{FormatMarkdown, FormatGemtext} {
+		input := append([]byte("\xff\xfe"), encodeUTF16("# Café\n", false)...)
+		got := convert(t, string(input), format, Options{})
+		if !strings.Contains(got, ">Café</h1>") {
+			t.Errorf("%s: got %q, want a Café heading", format, got)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package render
+
+import (
+	"html"
+
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/parser"
+	"github.com/yuin/goldmark/renderer"
+	gmhtml "github.com/yuin/goldmark/renderer/html"
+	"github.com/yuin/goldmark/text"
+	"github.com/yuin/goldmark/util"
+)
+
+// Goldmark extension that renders an image with a title on its own in a
+// paragraph as <figure class="image">, with the title as caption, like
+// Gemtext images with -inline-images.
+var Figures = &figuresExtension{}
+
+var kindFigure = ast.NewNodeKind("Figure")
+
+type figure struct {
+	ast.BaseBlock
+}
+
+func (n *figure) Kind() ast.NodeKind {
+	return kindFigure
+}
+
+func (n *figure) Dump(source []byte, level int) {
+	ast.DumpHelper(n, source, level, nil, nil)
+}
+
+type figuresTransformer struct{}
+
+func (t *figuresTransformer) Transform(doc *ast.Document, reader text.Reader, pc parser.Context) {
+	var paragraphs []*ast.Paragraph
+	ast.Walk(doc, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		if p, ok := n.(*ast.Paragraph); ok && entering && p.ChildCount() == 1 {
+			if img, ok := p.FirstChild().(*ast.Image); ok && len(img.Title) > 0 {
+				paragraphs = append(paragraphs, p)
+			}
+		}
+		return ast.WalkContinue, nil
+	})
+	for _, p := range paragraphs {
+		f := &figure{}
+		f.SetLines(p.Lines())
+		for _, attr := range p.Attributes() {
+			f.SetAttribute(attr.Name, attr.Value)
+		}
+		f.AppendChild(f, p.FirstChild())
+		p.Parent().ReplaceChild(p.Parent(), p, f)
+	}
+}
+
+type figuresRenderer struct{}
+
+func (r *figuresRenderer) RegisterFuncs(reg renderer.NodeRendererFuncRegisterer) {
+	reg.Register(kindFigure, r.render)
+}
+
+func (r *figuresRenderer) render(w util.BufWriter, source []byte, n ast.Node, entering bool) (ast.WalkStatus, error) {
+	if entering {
+		w.WriteString(`<figure class="image"`)
+		gmhtml.RenderAttributes(w, n, nil)
+		w.WriteString(">")
+	} else {
+		w.WriteString("<figcaption>")
+		w.WriteString(html.EscapeString(string(unescapeMarkdown(n.FirstChild().(*ast.Image).Title))))
+		w.WriteString("</figcaption></figure>\n")
+	}
+	return ast.WalkContinue, nil
+}
+
+type figuresExtension struct{}
+
+func (e *figuresExtension) Extend(m goldmark.Markdown) {
+	m.Parser().AddOptions(parser.WithASTTransformers(util.Prioritized(&figuresTransformer{}, 100)))
+	m.Renderer().AddOptions(renderer.WithNodeRenderers(util.Prioritized(&figuresRenderer{}, 100)))
+}
@@ -0,0 +1,725 @@
+package render
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"net/url"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/parser"
+)
+
+type Gemtext []Node
+
+type Node interface {
+	Line() int
+	Equal(o Node) bool
+}
+
+type node struct {
+	line int
+}
+
+func (n node) Line() int {
+	return n.line
+}
+
+// Text line, or lines separated by newlines with -merge-lines
+type Paragraph struct {
+	node
+	Text string
+}
+
+func (n *Paragraph) Equal(o Node) bool {
+	if o, ok := o.(*Paragraph); ok {
+		return n.Text == o.Text
+	}
+	return false
+}
+
+type Link struct {
+	node
+	URL   string
+	Label string
+}
+
+func (n *Link) Equal(o Node) bool {
+	if o, ok := o.(*Link); ok {
+		return n.URL == o.URL && n.Label == o.Label
+	}
+	return false
+}
+
+type Heading struct {
+	node
+	Level int
+	Text  string
+}
+
+func (n *Heading) Equal(o Node) bool {
+	if o, ok := o.(*Heading); ok {
+		return n.Level == o.Level && n.Text == o.Text
+	}
+	return false
+}
+
+type List struct {
+	node
+	Items []*Paragraph
+}
+
+func (n *List) Equal(o Node) bool {
+	if o, ok := o.(*List); ok {
+		return slices.EqualFunc(n.Items, o.Items, func(a *Paragraph, b *Paragraph) bool {
+			return a.Equal(b)
+		})
+	}
+	return false
+}
+
+// Non-standard separator line of 3 or more dashes
+type Rule struct {
+	node
+}
+
+func (n *Rule) Equal(o Node) bool {
+	_, ok := o.(*Rule)
+	return ok
+}
+
+// Numbered list, parsed with -ordered-lists
+type OrderedList struct {
+	node
+	Start int
+	Items []*Paragraph
+}
+
+func (n *OrderedList) Equal(o Node) bool {
+	if o, ok := o.(*OrderedList); ok {
+		return n.Start == o.Start && slices.EqualFunc(n.Items, o.Items, func(a *Paragraph, b *Paragraph) bool {
+			return a.Equal(b)
+		})
+	}
+	return false
+}
+
+type Quote struct {
+	node
+	Paragraphs []*Paragraph
+}
+
+func (n *Quote) Equal(o Node) bool {
+	if o, ok := o.(*Quote); ok {
+		return slices.EqualFunc(n.Paragraphs, o.Paragraphs, func(a *Paragraph, b *Paragraph) bool {
+			return a.Equal(b)
+		})
+	}
+	return false
+}
+
+type Pre struct {
+	node
+	Alt        string
+	Paragraphs []*Paragraph
+	// The closing fence is missing, so the block runs to the end of the file
+	Unterminated bool
+}
+
+func (n *Pre) Equal(o Node) bool {
+	if o, ok := o.(*Pre); ok {
+		return n.Alt == o.Alt && n.Unterminated == o.Unterminated && slices.EqualFunc(n.Paragraphs, o.Paragraphs, func(a *Paragraph, b *Paragraph) bool {
+			return a.Equal(b)
+		})
+	}
+	return false
+}
+
+// Returns the number of words of the text in the document
+func (gt Gemtext) Words() int {
+	words := 0
+	count := func(ps ...*Paragraph) {
+		for _, p := range ps {
+			words += len(strings.Fields(p.Text))
+		}
+	}
+	for _, n := range gt {
+		switch n := n.(type) {
+		case *Paragraph:
+			count(n)
+		case *Heading:
+			words += len(strings.Fields(n.Text))
+		case *List:
+			count(n.Items...)
+		case *OrderedList:
+			count(n.Items...)
+		case *Quote:
+			count(n.Paragraphs...)
+		}
+	}
+	return words
+}
+
+// Marshals the nodes as objects with their type, line, and fields.
+func (gt Gemtext) MarshalJSON() ([]byte, error) {
+	nodes := make([]map[string]any, 0, len(gt))
+	for _, n := range gt {
+		nodes = append(nodes, nodeJSON(n))
+	}
+	return json.Marshal(nodes)
+}
+
+func nodeJSON(n Node) map[string]any {
+	paragraphs := func(ps []*Paragraph) []map[string]any {
+		r := make([]map[string]any, 0, len(ps))
+		for _, p := range ps {
+			r = append(r, nodeJSON(p))
+		}
+		return r
+	}
+	m := map[string]any{"line": n.Line()}
+	switch n := n.(type) {
+	case *Paragraph:
+		m["type"] = "paragraph"
+		m["text"] = n.Text
+	case *Link:
+		m["type"] = "link"
+		m["url"] = n.URL
+		m["label"] = n.Label
+	case *Heading:
+		m["type"] = "heading"
+		m["level"] = n.Level
+		m["text"] = n.Text
+	case *List:
+		m["type"] = "list"
+		m["items"] = paragraphs(n.Items)
+	case *OrderedList:
+		m["type"] = "orderedList"
+		m["start"] = n.Start
+		m["items"] = paragraphs(n.Items)
+	case *Quote:
+		m["type"] = "quote"
+		m["paragraphs"] = paragraphs(n.Paragraphs)
+	case *Pre:
+		m["type"] = "pre"
+		m["alt"] = n.Alt
+		m["paragraphs"] = paragraphs(n.Paragraphs)
+		m["unterminated"] = n.Unterminated
+	case *Rule:
+		m["type"] = "rule"
+	}
+	return m
+}
+
+// Gemtext only defines 3 heading levels, but deeper ones are common enough to
+// support up to what HTML can render.
+const maxHeadingLevel = 6
+
+// Returns the number of leading '#' characters of a heading line, or 0 if the
+// line is not a heading.
+func headingMarker(text string) int {
+	n := 0
+	for n < len(text) && text[n] == '#' {
+		n++
+	}
+	if n == 0 || n == len(text) || text[n] != ' ' {
+		return 0
+	}
+	return n
+}
+
+func isRule(text string) bool {
+	text = strings.TrimRightFunc(text, unicode.IsSpace)
+	return len(text) >= 3 && strings.Trim(text, "-") == ""
+}
+
+// Drops trailing whitespace, and replaces tabs by spaces, so that whitespace
+// changes that don't show don't mark lines as changed. Preformatted text is
+// kept as is.
+func normalizeText(text string) string {
+	return strings.ReplaceAll(strings.TrimRightFunc(text, unicode.IsSpace), "\t", " ")
+}
+
+// Non-standard numbered list items ("1. Item")
+var orderedItemRE = regexp.MustCompile(`^(\d+)\. `)
+
+// Preformatted alt text that looks like a language name (e.g. "go", "c++")
+var languageRE = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_+#-]*$`)
+
+func ParseGemtext(r io.Reader, opts Options) (Gemtext, error) {
+	var result = []Node{}
+	scn := bufio.NewScanner(r)
+	// ScanLines also drops the trailing \r of CRLF line endings
+	scn.Split(bufio.ScanLines)
+	pre := false
+	// Quote and list lines are grouped with directly preceding lines of the
+	// same kind. Any other line (including a link) ends the group.
+	var prev Node
+	line := 0
+	for scn.Scan() {
+		line += 1
+		text := scn.Text()
+		node := node{line: line}
+		if pre {
+			if strings.HasPrefix(text, "```") {
+				pre = false
+			} else {
+				prev.(*Pre).Paragraphs = append(prev.(*Pre).Paragraphs, &Paragraph{node: node, Text: text})
+			}
+		} else {
+			var ok bool
+			if strings.HasPrefix(text, ">") {
+				var q *Quote
+				if q, ok = prev.(*Quote); !ok {
+					q = &Quote{node: node, Paragraphs: []*Paragraph{}}
+					result = append(result, q)
+					prev = q
+				}
+				q.Paragraphs = append(q.Paragraphs, &Paragraph{node: node, Text: normalizeText(strings.TrimLeftFunc(text[1:], unicode.IsSpace))})
+			} else if strings.HasPrefix(text, "* ") {
+				var q *List
+				if q, ok = prev.(*List); !ok {
+					q = &List{node: node, Items: []*Paragraph{}}
+					result = append(result, q)
+					prev = q
+				}
+				q.Items = append(q.Items, &Paragraph{node: node, Text: normalizeText(strings.TrimLeftFunc(text[2:], unicode.IsSpace))})
+			} else if m := orderedItemRE.FindStringSubmatch(text); opts.OrderedLists && m != nil {
+				var q *OrderedList
+				if q, ok = prev.(*OrderedList); !ok {
+					start, _ := strconv.Atoi(m[1])
+					q = &OrderedList{node: node, Start: start, Items: []*Paragraph{}}
+					result = append(result, q)
+					prev = q
+				}
+				q.Items = append(q.Items, &Paragraph{node: node, Text: normalizeText(strings.TrimLeftFunc(text[len(m[0]):], unicode.IsSpace))})
+			} else if n := headingMarker(text); n > 0 {
+				prev = &Heading{node: node, Level: min(n, maxHeadingLevel), Text: normalizeText(strings.TrimSpace(text[n:]))}
+				result = append(result, prev)
+			} else if strings.HasPrefix(text, "=>") && strings.TrimSpace(text[2:]) != "" {
+				// The space after => is optional
+				url := strings.TrimSpace(text[2:])
+				var label string
+				// The separator can be any (multi-byte) whitespace, so
+				// trim it instead of skipping a single byte
+				if i := strings.IndexFunc(url, unicode.IsSpace); i > 0 {
+					label = normalizeText(strings.TrimLeftFunc(url[i:], unicode.IsSpace))
+					url = url[:i]
+				}
+				prev = &Link{node: node, URL: url, Label: label}
+				result = append(result, prev)
+			} else if isRule(text) {
+				prev = &Rule{node: node}
+				result = append(result, prev)
+			} else if strings.HasPrefix(text, "```") {
+				pre = true
+				prev = &Pre{node: node, Alt: text[3:], Paragraphs: []*Paragraph{}}
+				result = append(result, prev)
+			} else if p, ok := prev.(*Paragraph); ok && opts.MergeLines && strings.TrimSpace(p.Text) != "" && strings.TrimSpace(text) != "" {
+				p.Text += "\n" + normalizeText(text)
+			} else {
+				prev = &Paragraph{node: node, Text: normalizeText(text)}
+				result = append(result, prev)
+			}
+		}
+	}
+	if pre {
+		prev.(*Pre).Unterminated = true
+	}
+	return result, scn.Err()
+}
+
+// Decorative, as the link label follows it
+var linkIcon = `<svg xmlns="http://www.w3.org/2000/svg" width="16" height="16" fill="currentColor" class="icon" viewBox="0 0 16 16" aria-hidden="true" focusable="false"><path d="M6.354 5.5H4a3 3 0 0 0 0 6h3a3 3 0 0 0 2.83-4H9c-.086 0-.17.01-.25.031A2 2 0 0 1 7 10.5H4a2 2 0 1 1 0-4h1.535c.218-.376.495-.714.82-1z"/><path d="M9 5.5a3 3 0 0 0-2.83 4h1.098A2 2 0 0 1 9 6.5h3a2 2 0 1 1 0 4h-1.535a4.02 4.02 0 0 1-.82 1H12a3 3 0 1 0 0-6z"/></svg>`
+
+// Writes a start tag. The attributes are sorted, so the same node always
+// gives the same HTML.
+func writeEl(w io.Writer, tag string, attrs map[string]string) {
+	io.WriteString(w, "<")
+	io.WriteString(w, tag)
+	keys := make([]string, 0, len(attrs))
+	for k := range attrs {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	for _, k := range keys {
+		io.WriteString(w, " ")
+		io.WriteString(w, k)
+		io.WriteString(w, "=\"")
+		io.WriteString(w, html.EscapeString(attrs[k]))
+		io.WriteString(w, "\"")
+	}
+	io.WriteString(w, ">")
+}
+
+// Non-standard inline markup, formatted with -inline
+var inlineRE = regexp.MustCompile("`([^`]+)`|\\*\\*(\\S(?:.*?\\S)?)\\*\\*|\\*(\\S(?:.*?\\S)?)\\*|~~(\\S(?:.*?\\S)?)~~")
+
+var inlineTags = []string{"code", "strong", "em", "del"}
+
+// Bare URLs, linked with -linkify
+var urlRE = regexp.MustCompile(`\b(?:https?|gemini)://[^\s<>"]+`)
+
+// Writes the text of a paragraph, list item or quote, escaped and optionally
+// with inline markup and links. Merged lines are separated by line breaks.
+func writeText(w io.Writer, text string, opts Options) {
+	for i, line := range strings.Split(text, "\n") {
+		if i > 0 {
+			io.WriteString(w, "<br>\n")
+		}
+		writeLine(w, line, opts)
+	}
+}
+
+func writeLine(w io.Writer, text string, opts Options) {
+	if !opts.Inline {
+		writePlain(w, text, opts.Linkify)
+		return
+	}
+	last := 0
+	for _, m := range inlineRE.FindAllStringSubmatchIndex(text, -1) {
+		writePlain(w, text[last:m[0]], opts.Linkify)
+		for i, tag := range inlineTags {
+			if start, end := m[2*i+2], m[2*i+3]; start >= 0 {
+				fmt.Fprintf(w, "<%s>", tag)
+				writePlain(w, text[start:end], opts.Linkify && tag != "code")
+				fmt.Fprintf(w, "</%s>", tag)
+				break
+			}
+		}
+		last = m[1]
+	}
+	writePlain(w, text[last:], opts.Linkify)
+}
+
+func writePlain(w io.Writer, text string, linkify bool) {
+	if !linkify {
+		io.WriteString(w, html.EscapeString(text))
+		return
+	}
+	last := 0
+	for _, m := range urlRE.FindAllStringIndex(text, -1) {
+		url := trimURL(text[m[0]:m[1]])
+		io.WriteString(w, html.EscapeString(text[last:m[0]]))
+		fmt.Fprintf(w, "<a href=\"%s\">%s</a>", html.EscapeString(url), html.EscapeString(url))
+		last = m[0] + len(url)
+	}
+	io.WriteString(w, html.EscapeString(text[last:]))
+}
+
+// Strips trailing punctuation that is more likely part of the sentence than of
+// the URL, keeping closing parentheses that have a matching opening one.
+func trimURL(url string) string {
+	for len(url) > 0 {
+		c := url[len(url)-1]
+		switch {
+		case strings.IndexByte(".,:;!?'*", c) >= 0:
+		case c == ')' && strings.Count(url, "(") < strings.Count(url, ")"):
+		default:
+			return url
+		}
+		url = url[:len(url)-1]
+	}
+	return url
+}
+
+var imageExtensions = []string{".png", ".jpg", ".jpeg", ".gif", ".webp", ".svg"}
+
+// Returns whether a link points to an image, going by its extension
+func isImageURL(rawURL string) bool {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return false
+	}
+	return slices.Contains(imageExtensions, strings.ToLower(path.Ext(u.Path)))
+}
+
+// Returns the images that are shown inline with -inline-images
+func (gt Gemtext) Images() []string {
+	var images []string
+	for _, n := range gt {
+		if l, ok := n.(*Link); ok && isImageURL(l.URL) {
+			images = append(images, l.URL)
+		}
+	}
+	return images
+}
+
+func isBlank(n Node) bool {
+	p, ok := n.(*Paragraph)
+	return ok && strings.TrimSpace(p.Text) == ""
+}
+
+// Limit on the size of the table used to diff documents. Bigger changes mark
+// everything between the unchanged start and end as changed.
+const maxDiffSize = 1 << 22
+
+// Returns which nodes of gt are not in the previous parse pgt, using the
+// longest common subsequence of both, so that moving a block only marks the
+// moved block.
+func changedNodes(gt Gemtext, pgt Gemtext) []bool {
+	changed := make([]bool, len(gt))
+	if pgt == nil {
+		return changed
+	}
+	start := 0
+	for start < len(gt) && start < len(pgt) && gt[start].Equal(pgt[start]) {
+		start++
+	}
+	end, pend := len(gt), len(pgt)
+	for end > start && pend > start && gt[end-1].Equal(pgt[pend-1]) {
+		end--
+		pend--
+	}
+	a, b := gt[start:end], pgt[start:pend]
+	if len(a)*len(b) > maxDiffSize {
+		for i := range a {
+			changed[start+i] = true
+		}
+		return changed
+	}
+
+	// lcs[i][j] is the length of the longest common subsequence of a[i:] and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i].Equal(b[j]) {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+	for i, j := 0, 0; i < len(a); {
+		switch {
+		case j < len(b) && a[i].Equal(b[j]):
+			i++
+			j++
+		case j < len(b) && lcs[i][j+1] >= lcs[i+1][j]:
+			j++
+		default:
+			changed[start+i] = true
+			i++
+		}
+	}
+	return changed
+}
+
+func GemtextToHTML(gt Gemtext, pgt Gemtext, opts Options, w io.Writer) error {
+	// Use the same heading IDs as goldmark
+	ids := parser.NewContext().IDs()
+	changed := changedNodes(gt, pgt)
+	prevBlank := false
+	for k, n := range gt {
+		// Collapse runs of blank lines into a single one
+		blank := isBlank(n)
+		if blank && prevBlank {
+			continue
+		}
+		prevBlank = blank
+
+		attrs := map[string]string{"data-line": strconv.Itoa(n.Line())}
+		if changed[k] && !blank {
+			attrs["class"] = "changed"
+		}
+		switch node := n.(type) {
+		case *Paragraph:
+			writeEl(w, "p", attrs)
+			writeText(w, node.Text, opts)
+			io.WriteString(w, "</p>")
+		case *Link:
+			if opts.InlineImages && isImageURL(node.URL) {
+				// The caption keeps the link, for when the image can't be shown
+				attrs["class"] = strings.TrimSpace("image " + attrs["class"])
+				writeEl(w, "figure", attrs)
+				writeEl(w, "img", map[string]string{"src": node.URL, "alt": node.Label})
+				io.WriteString(w, "<figcaption>")
+			} else {
+				attrs["class"] = strings.TrimSpace("link " + attrs["class"])
+				writeEl(w, "p", attrs)
+			}
+			io.WriteString(w, linkIcon)
+			io.WriteString(w, " ")
+			io.WriteString(w, fmt.Sprintf("<a href=\"%s\">", html.EscapeString(node.URL)))
+			if node.Label != "" {
+				io.WriteString(w, html.EscapeString(node.Label))
+			} else {
+				io.WriteString(w, html.EscapeString(node.URL))
+			}
+			io.WriteString(w, "</a>")
+			if opts.InlineImages && isImageURL(node.URL) {
+				io.WriteString(w, "</figcaption></figure>")
+			} else {
+				io.WriteString(w, "</p>")
+			}
+		case *Rule:
+			writeEl(w, "hr", attrs)
+		case *Heading:
+			attrs["id"] = string(ids.Generate([]byte(node.Text), ast.KindHeading))
+			writeEl(w, fmt.Sprintf("h%d", node.Level), attrs)
+			io.WriteString(w, html.EscapeString(node.Text))
+			io.WriteString(w, fmt.Sprintf("</h%d>", node.Level))
+		case *List:
+			writeEl(w, "ul", attrs)
+			for _, p := range node.Items {
+				writeEl(w, "li", map[string]string{"data-line": strconv.Itoa(p.line)})
+				writeText(w, p.Text, opts)
+				io.WriteString(w, "</li>")
+			}
+			io.WriteString(w, "</ul>")
+		case *OrderedList:
+			if node.Start != 1 {
+				attrs["start"] = strconv.Itoa(node.Start)
+			}
+			writeEl(w, "ol", attrs)
+			for _, p := range node.Items {
+				writeEl(w, "li", map[string]string{"data-line": strconv.Itoa(p.line)})
+				writeText(w, p.Text, opts)
+				io.WriteString(w, "</li>")
+			}
+			io.WriteString(w, "</ol>")
+		case *Quote:
+			io.WriteString(w, "<blockquote>")
+			for _, p := range node.Paragraphs {
+				attrs := map[string]string{"data-line": strconv.Itoa(p.line)}
+				writeEl(w, "p", attrs)
+				writeText(w, p.Text, opts)
+				io.WriteString(w, "</p>")
+			}
+			io.WriteString(w, "</blockquote>")
+		case *Pre:
+			// Alt text is shown as a caption, which can collapse the block
+			alt := strings.TrimSpace(node.Alt)
+			if alt != "" {
+				attrs["class"] = strings.TrimSpace("preformatted " + attrs["class"])
+				writeEl(w, "figure", attrs)
+				io.WriteString(w, `<figcaption class="alt">`)
+				io.WriteString(w, html.EscapeString(alt))
+				io.WriteString(w, "</figcaption>")
+				attrs = map[string]string{"aria-label": alt}
+			}
+			if node.Unterminated {
+				attrs["class"] = strings.TrimSpace("unterminated " + attrs["class"])
+				attrs["title"] = "This preformatted block is not closed"
+			}
+			writeEl(w, "pre", attrs)
+			if languageRE.MatchString(alt) {
+				writeEl(w, "code", map[string]string{"class": "language-" + strings.ToLower(alt)})
+			} else {
+				io.WriteString(w, "<code>")
+			}
+			for _, p := range node.Paragraphs {
+				io.WriteString(w, html.EscapeString(p.Text))
+				io.WriteString(w, "\n")
+			}
+			io.WriteString(w, "</code></pre>")
+			if alt != "" {
+				io.WriteString(w, "</figure>")
+			}
+		}
+		io.WriteString(w, "\n")
+	}
+	return nil
+}
+
+// Characters that are escaped in markdown text
+var markdownEscaper = strings.NewReplacer(
+	`\`, `\\`, "`", "\\`", `*`, `\*`, `_`, `\_`, `[`, `\[`, `]`, `\]`,
+	`<`, `\<`, `>`, `\>`, `~`, `\~`, `|`, `\|`, `$`, `\$`, `&`, `\&`,
+)
+
+// Block markers at the start of a markdown line
+var markdownBlockRE = regexp.MustCompile(`^(#|[-+=]|\d+[.)])`)
+
+// Escapes text so that markdown shows it literally
+func escapeMarkdown(text string) string {
+	text = markdownEscaper.Replace(strings.TrimLeftFunc(text, unicode.IsSpace))
+	if m := markdownBlockRE.FindStringIndex(text); m != nil {
+		text = text[:m[1]-1] + `\` + text[m[1]-1:]
+	}
+	return text
+}
+
+// Converts Gemtext to markdown. Every text line becomes a paragraph, and links
+// are written as a paragraph with only the link.
+func GemtextToMarkdown(gt Gemtext, w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	first := true
+	for _, n := range gt {
+		if isBlank(n) {
+			continue
+		}
+		if !first {
+			bw.WriteString("\n")
+		}
+		first = false
+		switch node := n.(type) {
+		case *Paragraph:
+			for i, line := range strings.Split(node.Text, "\n") {
+				if i > 0 {
+					bw.WriteString("\\\n")
+				}
+				bw.WriteString(escapeMarkdown(line))
+			}
+			bw.WriteString("\n")
+		case *Link:
+			label := node.Label
+			if label == "" {
+				label = node.URL
+			}
+			url := node.URL
+			if strings.ContainsAny(url, " ()<>") {
+				url = "<" + strings.NewReplacer("<", "%3C", ">", "%3E").Replace(url) + ">"
+			}
+			fmt.Fprintf(bw, "[%s](%s)\n", escapeMarkdown(label), url)
+		case *Heading:
+			fmt.Fprintf(bw, "%s %s\n", strings.Repeat("#", node.Level), escapeMarkdown(node.Text))
+		case *List:
+			for _, p := range node.Items {
+				fmt.Fprintf(bw, "- %s\n", escapeMarkdown(p.Text))
+			}
+		case *OrderedList:
+			for i, p := range node.Items {
+				fmt.Fprintf(bw, "%d. %s\n", node.Start+i, escapeMarkdown(p.Text))
+			}
+		case *Quote:
+			for i, p := range node.Paragraphs {
+				if i > 0 {
+					bw.WriteString(">\n")
+				}
+				fmt.Fprintf(bw, "> %s\n", escapeMarkdown(p.Text))
+			}
+		case *Pre:
+			// The fence has to be longer than any fence in the block
+			fence := "```"
+			for _, p := range node.Paragraphs {
+				for strings.HasPrefix(strings.TrimSpace(p.Text), fence) {
+					fence += "`"
+				}
+			}
+			alt := strings.TrimSpace(node.Alt)
+			if strings.Contains(alt, "`") {
+				fence = strings.Repeat("~", len(fence))
+			}
+			bw.WriteString(fence + alt + "\n")
+			for _, p := range node.Paragraphs {
+				bw.WriteString(p.Text + "\n")
+			}
+			bw.WriteString(fence + "\n")
+		case *Rule:
+			bw.WriteString("---\n")
+		}
+	}
+	return bw.Flush()
+}
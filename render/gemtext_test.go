@@ -0,0 +1,673 @@
+package render
+
+import (
+	"bytes"
+	"encoding/json"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func parseGemtext(t *testing.T, input string, opts Options) Gemtext {
+	t.Helper()
+	gt, err := ParseGemtext(strings.NewReader(input), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return gt
+}
+
+func gemtextToHTML(t *testing.T, input string, opts Options) string {
+	t.Helper()
+	var out strings.Builder
+	if err := GemtextToHTML(parseGemtext(t, input, opts), nil, opts, &out); err != nil {
+		t.Fatal(err)
+	}
+	return out.String()
+}
+
+// Compares documents, including line numbers
+func gemtextEqual(a Gemtext, b Gemtext) bool {
+	ja, _ := json.Marshal(a)
+	jb, _ := json.Marshal(b)
+	return bytes.Equal(ja, jb)
+}
+
+func dumpGemtext(gt Gemtext) string {
+	j, _ := json.Marshal(gt)
+	return string(j)
+}
+
+func TestGemtextEscaping(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"* <script>alert(1)</script>", `<ul data-line="1"><li data-line="1">&lt;script&gt;alert(1)&lt;/script&gt;</li></ul>`},
+		{"* a & b", `<li data-line="1">a &amp; b</li>`},
+		{"<b>text</b>", `<p data-line="1">&lt;b&gt;text&lt;/b&gt;</p>`},
+		{"# <i>", `>&lt;i&gt;</h1>`},
+		{"> <q>", `<p data-line="1">&lt;q&gt;</p>`},
+	}
+	for _, test := range tests {
+		if got := gemtextToHTML(t, test.input, Options{}); !strings.Contains(got, test.want) {
+			t.Errorf("%q: got %q, want it to contain %q", test.input, got, test.want)
+		}
+	}
+}
+
+func TestGemtextQuote(t *testing.T) {
+	tests := []struct {
+		input string
+		want  []string
+	}{
+		{"> quoted", []string{"quoted"}},
+		{">quoted", []string{"quoted"}},
+		{">   quoted", []string{"quoted"}},
+		{">", []string{""}},
+		{"> a\n> b", []string{"a", "b"}},
+		{"> > nested", []string{"> nested"}},
+	}
+	for _, test := range tests {
+		gt := parseGemtext(t, test.input, Options{})
+		q, ok := gt[0].(*Quote)
+		if len(gt) != 1 || !ok {
+			t.Errorf("%q: got %v, want one quote", test.input, gt)
+			continue
+		}
+		var got []string
+		for _, p := range q.Paragraphs {
+			got = append(got, p.Text)
+		}
+		if !slices.Equal(got, test.want) {
+			t.Errorf("%q: got %q, want %q", test.input, got, test.want)
+		}
+	}
+}
+
+func TestGemtextHeadings(t *testing.T) {
+	tests := []struct {
+		input string
+		level int
+		text  string
+	}{
+		{"# One", 1, "One"},
+		{"## Two", 2, "Two"},
+		{"### Three", 3, "Three"},
+		{"#### Four", 4, "Four"},
+		{"######## Eight", maxHeadingLevel, "Eight"},
+		{"#   Spaces  ", 1, "Spaces"},
+		{"# #a", 1, "#a"},
+		{"## b#c", 2, "b#c"},
+		{"## ##", 2, "##"},
+		{"### # c #", 3, "# c #"},
+		{"#NoSpace", 0, ""},
+		{"#", 0, ""},
+	}
+	for _, test := range tests {
+		gt := parseGemtext(t, test.input, Options{})
+		h, ok := gt[0].(*Heading)
+		if test.level == 0 {
+			if ok {
+				t.Errorf("%q: got heading %q, want none", test.input, h.Text)
+			}
+			continue
+		}
+		if !ok || h.Level != test.level || h.Text != test.text {
+			t.Errorf("%q: got %#v, want level %d heading %q", test.input, gt[0], test.level, test.text)
+		}
+	}
+
+	html := gemtextToHTML(t, "#### Four", Options{})
+	if want := `<h4 data-line="1" id="four">Four</h4>`; !strings.Contains(html, want) {
+		t.Errorf("got %q, want it to contain %q", html, want)
+	}
+}
+
+func TestGemtextCRLF(t *testing.T) {
+	gt := parseGemtext(t, "# Title\r\ntext\r\n=> url label\r\n* item\r\n", Options{})
+	want := Gemtext{
+		&Heading{node: node{line: 1}, Level: 1, Text: "Title"},
+		&Paragraph{node: node{line: 2}, Text: "text"},
+		&Link{node: node{line: 3}, URL: "url", Label: "label"},
+		&List{node: node{line: 4}, Items: []*Paragraph{{node: node{line: 4}, Text: "item"}}},
+	}
+	if !gemtextEqual(gt, want) {
+		t.Errorf("got %s, want %s", dumpGemtext(gt), dumpGemtext(want))
+	}
+}
+
+func TestGemtextGrouping(t *testing.T) {
+	gt := parseGemtext(t, "* a\n* b\n=> url link\n* c\n> q\n=> url2\n> r", Options{})
+	want := Gemtext{
+		&List{node: node{line: 1}, Items: []*Paragraph{{node: node{line: 1}, Text: "a"}, {node: node{line: 2}, Text: "b"}}},
+		&Link{node: node{line: 3}, URL: "url", Label: "link"},
+		&List{node: node{line: 4}, Items: []*Paragraph{{node: node{line: 4}, Text: "c"}}},
+		&Quote{node: node{line: 5}, Paragraphs: []*Paragraph{{node: node{line: 5}, Text: "q"}}},
+		&Link{node: node{line: 6}, URL: "url2"},
+		&Quote{node: node{line: 7}, Paragraphs: []*Paragraph{{node: node{line: 7}, Text: "r"}}},
+	}
+	if !gemtextEqual(gt, want) {
+		t.Errorf("got %s, want %s", dumpGemtext(gt), dumpGemtext(want))
+	}
+
+	html := gemtextToHTML(t, "* a\n=> url link\n* b", Options{})
+	want2 := `<ul data-line="1"><li data-line="1">a</li></ul>` + "\n" +
+		`<p class="link" data-line="2">` + linkIcon + ` <a href="url">link</a></p>` + "\n" +
+		`<ul data-line="3"><li data-line="3">b</li></ul>` + "\n"
+	if html != want2 {
+		t.Errorf("got %q, want %q", html, want2)
+	}
+}
+
+func TestGemtextBlankLines(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"a\n\n\n\nb", `<p data-line="1">a</p>` + "\n" + `<p data-line="2"></p>` + "\n" + `<p data-line="5">b</p>` + "\n"},
+		{"a\n\nb", `<p data-line="1">a</p>` + "\n" + `<p data-line="2"></p>` + "\n" + `<p data-line="3">b</p>` + "\n"},
+		{"a\n \n\t\nb", `<p data-line="1">a</p>` + "\n" + `<p data-line="2"></p>` + "\n" + `<p data-line="4">b</p>` + "\n"},
+	}
+	for _, test := range tests {
+		if got := gemtextToHTML(t, test.input, Options{}); got != test.want {
+			t.Errorf("%q: got %q, want %q", test.input, got, test.want)
+		}
+	}
+}
+
+func TestGemtextLinks(t *testing.T) {
+	tests := []struct {
+		input string
+		url   string
+		label string
+	}{
+		{"=> url label", "url", "label"},
+		{"=> url\tlabel", "url", "label"},
+		{"=>   url   label  ", "url", "label"},
+		{"=>url", "url", ""},
+		{"=> url\u3000label", "url", "label"},
+		{"=> url a\tb", "url", "a b"},
+		// Not links
+		{"=> ", "", ""},
+		{"=>", "", ""},
+	}
+	for _, test := range tests {
+		gt := parseGemtext(t, test.input, Options{})
+		l, ok := gt[0].(*Link)
+		if test.url == "" {
+			if ok {
+				t.Errorf("%q: got link %q, want none", test.input, l.URL)
+			}
+			continue
+		}
+		if !ok || l.URL != test.url || l.Label != test.label {
+			t.Errorf("%q: got %s, want link %q with label %q", test.input, dumpGemtext(gt), test.url, test.label)
+		}
+	}
+}
+
+func TestGemtextLinkMarkup(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"=> https://example.com Example", `<p class="link" data-line="1"><svg `},
+		{"=> https://example.com Example", ` <a href="https://example.com">Example</a></p>`},
+		{"=> a?b&c", `<a href="a?b&amp;c">a?b&amp;c</a>`},
+		{"=> url <b>", `<a href="url">&lt;b&gt;</a>`},
+	}
+	for _, test := range tests {
+		if got := gemtextToHTML(t, test.input, Options{}); !strings.Contains(got, test.want) {
+			t.Errorf("%q: got %q, want it to contain %q", test.input, got, test.want)
+		}
+	}
+
+	// The icon is decorative, as the label follows it
+	for _, attr := range []string{`aria-hidden="true"`, `focusable="false"`} {
+		if !strings.Contains(linkIcon, attr) {
+			t.Errorf("got icon %q, want it to have %s", linkIcon, attr)
+		}
+	}
+	if strings.Contains(linkIcon, "aria-label") {
+		t.Errorf("got icon %q, want no label", linkIcon)
+	}
+}
+
+func TestGemtextOrderedLists(t *testing.T) {
+	item := func(line int, text string) *Paragraph {
+		return &Paragraph{node: node{line: line}, Text: text}
+	}
+	tests := []struct {
+		input string
+		opts  Options
+		want  Gemtext
+	}{
+		{"1. a\n2. b", Options{}, Gemtext{item(1, "1. a"), item(2, "2. b")}},
+		{"1. a\n2. b", Options{OrderedLists: true}, Gemtext{
+			&OrderedList{node: node{line: 1}, Start: 1, Items: []*Paragraph{item(1, "a"), item(2, "b")}},
+		}},
+		{"3. a\n7. b", Options{OrderedLists: true}, Gemtext{
+			&OrderedList{node: node{line: 1}, Start: 3, Items: []*Paragraph{item(1, "a"), item(2, "b")}},
+		}},
+		// Mixed with unordered lists
+		{"1. a\n* b\n2. c", Options{OrderedLists: true}, Gemtext{
+			&OrderedList{node: node{line: 1}, Start: 1, Items: []*Paragraph{item(1, "a")}},
+			&List{node: node{line: 2}, Items: []*Paragraph{item(2, "b")}},
+			&OrderedList{node: node{line: 3}, Start: 2, Items: []*Paragraph{item(3, "c")}},
+		}},
+		// Gemtext has no nesting, so indented items are text
+		{"1. a\n  2. b\n1.b", Options{OrderedLists: true}, Gemtext{
+			&OrderedList{node: node{line: 1}, Start: 1, Items: []*Paragraph{item(1, "a")}},
+			item(2, "  2. b"),
+			item(3, "1.b"),
+		}},
+	}
+	for _, test := range tests {
+		if got := parseGemtext(t, test.input, test.opts); !gemtextEqual(got, test.want) {
+			t.Errorf("%q: got %s, want %s", test.input, dumpGemtext(got), dumpGemtext(test.want))
+		}
+	}
+
+	html := gemtextToHTML(t, "3. a\n4. b", Options{OrderedLists: true})
+	if want := `<ol data-line="1" start="3"><li data-line="1">a</li><li data-line="2">b</li></ol>`; !strings.Contains(html, want) {
+		t.Errorf("got %q, want it to contain %q", html, want)
+	}
+}
+
+func TestGemtextPreformatted(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		// Escaped
+		{"```\nif a < b && c > d\n```", `<pre data-line="1"><code>if a &lt; b &amp;&amp; c &gt; d` + "\n</code></pre>\n"},
+		{"```\n<script>\n```", `<pre data-line="1"><code>&lt;script&gt;` + "\n</code></pre>\n"},
+		// Code with a language class, if the alt text looks like one
+		{"```\na\n\nb\n```", `<pre data-line="1"><code>a` + "\n\nb\n</code></pre>\n"},
+		{"```Go\nx\n```", `<figure class="preformatted" data-line="1"><figcaption class="alt">Go</figcaption><pre aria-label="Go"><code class="language-go">x` + "\n</code></pre></figure>\n"},
+		{"```c++\nx\n```", `<code class="language-c++">`},
+		{"```not a language\nx\n```", `<pre aria-label="not a language"><code>x`},
+		// Alt text as caption, only when there is some
+		{"```ASCII art\n<>\n```", `<figure class="preformatted" data-line="1"><figcaption class="alt">ASCII art</figcaption><pre aria-label="ASCII art"><code>&lt;&gt;` + "\n</code></pre></figure>\n"},
+		{"```   \nx\n```", `<pre data-line="1"><code>x` + "\n</code></pre>\n"},
+	}
+	for _, test := range tests {
+		if got := gemtextToHTML(t, test.input, Options{}); !strings.Contains(got, test.want) {
+			t.Errorf("%q: got %q, want it to contain %q", test.input, got, test.want)
+		}
+	}
+}
+
+func TestGemtextUnterminatedPre(t *testing.T) {
+	tests := []struct {
+		input        string
+		unterminated bool
+	}{
+		{"```\na\n```\nb", false},
+		{"```\na\n```", false},
+		{"```\na\nb", true},
+		{"text\n```alt", true},
+		{"```\n```\n```", true},
+	}
+	for _, test := range tests {
+		gt := parseGemtext(t, test.input, Options{})
+		var pre *Pre
+		for _, n := range gt {
+			if p, ok := n.(*Pre); ok {
+				pre = p
+			}
+		}
+		if pre == nil {
+			t.Errorf("%q: got %s, want a preformatted block", test.input, dumpGemtext(gt))
+			continue
+		}
+		if pre.Unterminated != test.unterminated {
+			t.Errorf("%q: got unterminated %v", test.input, pre.Unterminated)
+		}
+		if got := strings.Contains(dumpGemtext(gt), `"unterminated":true`); got != test.unterminated {
+			t.Errorf("%q: got JSON %s", test.input, dumpGemtext(gt))
+		}
+		html := gemtextToHTML(t, test.input, Options{})
+		if got := strings.Contains(html, `class="unterminated"`); got != test.unterminated {
+			t.Errorf("%q: got %q", test.input, html)
+		}
+	}
+
+	// Closing the block marks it as changed
+	var out strings.Builder
+	prev := parseGemtext(t, "```\na", Options{})
+	if err := GemtextToHTML(parseGemtext(t, "```\na\n```", Options{}), prev, Options{}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if want := `<pre class="changed"`; !strings.Contains(out.String(), want) {
+		t.Errorf("got %q, want it to contain %q", out.String(), want)
+	}
+}
+
+func TestGemtextWhitespace(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"text  \t", `"text":"text"`},
+		{"a\tb", `"text":"a b"`},
+		{"* item\t ", `"text":"item"`},
+		{"> a\tquote ", `"text":"a quote"`},
+		{"## a\theading ", `"text":"a heading"`},
+		{"=> url a\tlabel ", `"label":"a label"`},
+		{"   ", `"text":""`},
+		// Preformatted text is verbatim
+		{"```\n\tcode  \n```", `"text":"\tcode  "`},
+	}
+	for _, test := range tests {
+		if got := dumpGemtext(parseGemtext(t, test.input, Options{})); !strings.Contains(got, test.want) {
+			t.Errorf("%q: got %s, want it to contain %s", test.input, got, test.want)
+		}
+	}
+
+	// Whitespace that doesn't show doesn't mark blocks as changed
+	prev := parseGemtext(t, "a\n* b\n```\nc\n```", Options{})
+	cur := parseGemtext(t, "a \n* b\t\n```\nc\n```", Options{})
+	if got, want := changedNodes(cur, prev), []bool{false, false, false}; !slices.Equal(got, want) {
+		t.Errorf("got changed %v, want %v", got, want)
+	}
+	cur = parseGemtext(t, "a\n* b\n```\nc \n```", Options{})
+	if got, want := changedNodes(cur, prev), []bool{false, false, true}; !slices.Equal(got, want) {
+		t.Errorf("got changed %v, want %v", got, want)
+	}
+}
+
+func TestGemtextLinkify(t *testing.T) {
+	tests := []struct {
+		input   string
+		linkify bool
+		want    string
+	}{
+		{"See https://example.com.", false, `<p data-line="1">See https://example.com.</p>`},
+		{"See https://example.com.", true, `<p data-line="1">See <a href="https://example.com">https://example.com</a>.</p>`},
+		{"(gemini://example.com/a_(b))", true, `(<a href="gemini://example.com/a_(b)">gemini://example.com/a_(b)</a>)`},
+		{"* https://example.com/?a=1&b=2", true, `<li data-line="1"><a href="https://example.com/?a=1&amp;b=2">https://example.com/?a=1&amp;b=2</a></li>`},
+		{"<https://example.com>", true, `&lt;<a href="https://example.com">https://example.com</a>&gt;`},
+	}
+	for _, test := range tests {
+		if got := gemtextToHTML(t, test.input, Options{Linkify: test.linkify}); !strings.Contains(got, test.want) {
+			t.Errorf("%q: got %q, want it to contain %q", test.input, got, test.want)
+		}
+	}
+}
+
+// Paragraphs, list items and quotes format their text the same way
+func TestGemtextInlineText(t *testing.T) {
+	blocks := []struct {
+		prefix string
+		start  string
+		end    string
+	}{
+		{"", `<p data-line="1">`, "</p>"},
+		{"* ", `<li data-line="1">`, "</li>"},
+		{"> ", `<blockquote><p data-line="1">`, "</p></blockquote>"},
+	}
+	tests := []struct {
+		input string
+		opts  Options
+		want  string
+	}{
+		{"*a* https://example.com", Options{}, `*a* https://example.com`},
+		{"*a* https://example.com", Options{Linkify: true}, `*a* <a href="https://example.com">https://example.com</a>`},
+		{"*a* https://example.com", Options{Inline: true}, `<em>a</em> https://example.com`},
+		{"*a* https://example.com", Options{Inline: true, Linkify: true}, `<em>a</em> <a href="https://example.com">https://example.com</a>`},
+		{"**https://example.com** `https://example.com`", Options{Inline: true, Linkify: true},
+			`<strong><a href="https://example.com">https://example.com</a></strong> <code>https://example.com</code>`},
+		{"~~<b>~~", Options{Inline: true}, `<del>&lt;b&gt;</del>`},
+	}
+	for _, block := range blocks {
+		for _, test := range tests {
+			input := block.prefix + test.input
+			want := block.start + test.want + block.end
+			if got := gemtextToHTML(t, input, test.opts); !strings.Contains(got, want) {
+				t.Errorf("%q %+v: got %q, want it to contain %q", input, test.opts, got, want)
+			}
+		}
+	}
+}
+
+func TestChangedNodes(t *testing.T) {
+	tests := []struct {
+		name string
+		prev string
+		cur  string
+		want []bool
+	}{
+		{"unchanged", "a\nb\nc", "a\nb\nc", []bool{false, false, false}},
+		{"first parse", "", "a\nb", []bool{false, false}},
+		{"edit", "a\nb\nc", "a\nB\nc", []bool{false, true, false}},
+		{"insertion", "a\nb\nc", "a\nx\nb\nc", []bool{false, true, false, false}},
+		{"insertion at start", "a\nb", "x\na\nb", []bool{true, false, false}},
+		{"deletion", "a\nb\nc", "a\nc", []bool{false, false}},
+		{"move up", "a\nb\nc\nd", "d\na\nb\nc", []bool{true, false, false, false}},
+		{"move down", "a\nb\nc\nd", "b\nc\nd\na", []bool{false, false, false, true}},
+		// Only one of the swapped blocks can be kept
+		{"swap", "a\nb\nc\nd", "a\nc\nb\nd", []bool{false, false, true, false}},
+		{"list item", "* a\n* b\n\nc", "* a\n* x\n\nc", []bool{true, false, false}},
+	}
+	for _, test := range tests {
+		var prev Gemtext
+		if test.name != "first parse" {
+			prev = parseGemtext(t, test.prev, Options{})
+		}
+		got := changedNodes(parseGemtext(t, test.cur, Options{}), prev)
+		if !slices.Equal(got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+
+	// Changed blocks are marked, except blank lines
+	var out strings.Builder
+	prev := parseGemtext(t, "a\n\nb", Options{})
+	if err := GemtextToHTML(parseGemtext(t, "a\n\n\nB", Options{}), prev, Options{}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if want := `<p data-line="1">a</p>` + "\n" + `<p data-line="2"></p>` + "\n" + `<p class="changed" data-line="4">B</p>` + "\n"; out.String() != want {
+		t.Errorf("got %q, want %q", out.String(), want)
+	}
+}
+
+func TestGemtextListMarkup(t *testing.T) {
+	got := gemtextToHTML(t, "* a\n* b\n* c", Options{})
+	want := `<ul data-line="1"><li data-line="1">a</li><li data-line="2">b</li><li data-line="3">c</li></ul>` + "\n"
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if n := strings.Count(got, "<li"); n != 3 {
+		t.Errorf("got %d <li> tags, want 3", n)
+	}
+}
+
+func TestGemtextMergeLines(t *testing.T) {
+	input := "a\nb\n\nc\n* d\ne"
+	tests := []struct {
+		merge bool
+		want  string
+	}{
+		{false, `<p data-line="1">a</p>` + "\n" + `<p data-line="2">b</p>` + "\n" + `<p data-line="3"></p>` + "\n" +
+			`<p data-line="4">c</p>` + "\n" + `<ul data-line="5"><li data-line="5">d</li></ul>` + "\n" + `<p data-line="6">e</p>` + "\n"},
+		{true, `<p data-line="1">a<br>` + "\n" + `b</p>` + "\n" + `<p data-line="3"></p>` + "\n" +
+			`<p data-line="4">c</p>` + "\n" + `<ul data-line="5"><li data-line="5">d</li></ul>` + "\n" + `<p data-line="6">e</p>` + "\n"},
+	}
+	for _, test := range tests {
+		if got := gemtextToHTML(t, input, Options{MergeLines: test.merge}); got != test.want {
+			t.Errorf("merge %v: got %q, want %q", test.merge, got, test.want)
+		}
+	}
+}
+
+func TestGemtextHeadingIDs(t *testing.T) {
+	got := gemtextToHTML(t, "# Intro\n## Intro\n### Intro\n# Intro 2!", Options{})
+	for _, want := range []string{
+		`<h1 data-line="1" id="intro">Intro</h1>`,
+		`<h2 data-line="2" id="intro-1">Intro</h2>`,
+		`<h3 data-line="3" id="intro-2">Intro</h3>`,
+		`<h1 data-line="4" id="intro-2-1">Intro 2!</h1>`,
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("got %q, want it to contain %q", got, want)
+		}
+	}
+}
+
+func TestGemtextToMarkdown(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"# Title\n## Sub", "# Title\n\n## Sub\n"},
+		{"text\n\n\nmore", "text\n\nmore\n"},
+		{"=> gemini://example.com Label", "[Label](gemini://example.com)\n"},
+		{"=> https://example.com", "[https://example.com](https://example.com)\n"},
+		{"=> https://example.com/a(b) x", "[x](<https://example.com/a(b)>)\n"},
+		{"* a\n* b", "- a\n- b\n"},
+		{"> a\n> b", "> a\n>\n> b\n"},
+		{"```go\nx := 1\n```", "```go\nx := 1\n```\n"},
+		{"```\n ```inner\n```", "````\n ```inner\n````\n"},
+		{"---", "---\n"},
+		// Text that would be markdown syntax is escaped
+		{"*not emphasis* [x](y) <b>", "\\*not emphasis\\* \\[x\\](y) \\<b\\>\n"},
+		{"#tag", "\\#tag\n"},
+		{"- dash\n1. one", "\\- dash\n\n1\\. one\n"},
+	}
+	for _, test := range tests {
+		var out strings.Builder
+		if err := GemtextToMarkdown(parseGemtext(t, test.input, Options{}), &out); err != nil {
+			t.Fatal(err)
+		}
+		if out.String() != test.want {
+			t.Errorf("%q: got %q, want %q", test.input, out.String(), test.want)
+		}
+	}
+
+	// The markdown shows the same text
+	var md strings.Builder
+	if err := GemtextToMarkdown(parseGemtext(t, "a *b* `c` <d> & e_f_", Options{}), &md); err != nil {
+		t.Fatal(err)
+	}
+	html := convert(t, md.String(), FormatMarkdown, Options{})
+	if want := `<p data-line="1">a *b* ` + "`c`" + ` &lt;d&gt; &amp; e_f_</p>`; !strings.Contains(html, want) {
+		t.Errorf("got %q, want it to contain %q", html, want)
+	}
+}
+
+func TestGemtextInlineImages(t *testing.T) {
+	tests := []struct {
+		input string
+		image bool
+	}{
+		{"=> cat.png A cat", true},
+		{"=> cat.JPG", true},
+		{"=> cat.jpeg", true},
+		{"=> https://example.com/cat.gif?size=2#x", true},
+		{"=> cat.webp", true},
+		{"=> cat.svg", true},
+		{"=> cat.png.html", false},
+		{"=> https://example.com/png", false},
+		{"=> gemini://example.com/", false},
+	}
+	for _, test := range tests {
+		gt := parseGemtext(t, test.input, Options{})
+		if got := len(gt.Images()) == 1; got != test.image {
+			t.Errorf("%q: got image %v, want %v", test.input, got, test.image)
+		}
+		html := gemtextToHTML(t, test.input, Options{InlineImages: true})
+		if got := strings.Contains(html, "<img "); got != test.image {
+			t.Errorf("%q: got %q, want image %v", test.input, html, test.image)
+		}
+		// The link is kept, for when the image can't be shown
+		if !strings.Contains(html, "<a href=") {
+			t.Errorf("%q: got %q, want a link", test.input, html)
+		}
+		if html := gemtextToHTML(t, test.input, Options{}); strings.Contains(html, "<img ") {
+			t.Errorf("%q: got %q without -inline-images", test.input, html)
+		}
+	}
+
+	got := gemtextToHTML(t, `=> cat.png A "cat"`, Options{InlineImages: true})
+	want := `<figure class="image" data-line="1"><img alt="A &#34;cat&#34;" src="cat.png"><figcaption>` + linkIcon + ` <a href="cat.png">A &#34;cat&#34;</a></figcaption></figure>` + "\n"
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func FuzzParseGemtext(f *testing.F) {
+	for _, seed := range []string{
+		"",
+		">",
+		"=>",
+		"=> ",
+		"=>\t",
+		"=> x",
+		"*",
+		"* ",
+		"#",
+		"# ",
+		"#######x",
+		"```",
+		"```go\ncode",
+		"1. ",
+		"---",
+		"text\r\n",
+		"=> gemini://example.com Label\n",
+		"> a\n>\n* b\n=> c\n* d\n",
+		"*a **b** `c` ~~d~~ https://example.com.*",
+	} {
+		f.Add(seed, uint8(0))
+		f.Add(seed, uint8(0xff))
+	}
+	f.Fuzz(func(t *testing.T, input string, flags uint8) {
+		opts := Options{
+			Inline:       flags&1 != 0,
+			Linkify:      flags&2 != 0,
+			OrderedLists: flags&4 != 0,
+			MergeLines:   flags&8 != 0,
+			InlineImages: flags&16 != 0,
+		}
+		gt, err := ParseGemtext(strings.NewReader(input), opts)
+		if err != nil {
+			// Lines longer than the scanner's buffer
+			return
+		}
+		lines := strings.Count(input, "\n") + 1
+		for _, n := range gt {
+			if n.Line() < 1 || n.Line() > lines {
+				t.Fatalf("line %d out of range 1-%d", n.Line(), lines)
+			}
+		}
+
+		// Parsing again gives the same document, so nothing is marked as changed
+		gt2, err := ParseGemtext(strings.NewReader(input), opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(gt2) != len(gt) {
+			t.Fatalf("got %d nodes, then %d", len(gt), len(gt2))
+		}
+		for i, changed := range changedNodes(gt2, gt) {
+			if changed || !gt2[i].Equal(gt[i]) {
+				t.Fatalf("node %d changed on reparse", i)
+			}
+		}
+
+		var out bytes.Buffer
+		if err := GemtextToHTML(gt, nil, opts, &out); err != nil {
+			t.Fatal(err)
+		}
+		if err := GemtextToHTML(gt2, gt, opts, &out); err != nil {
+			t.Fatal(err)
+		}
+		if err := GemtextToMarkdown(gt, &out); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := json.Marshal(gt); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
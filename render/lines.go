@@ -0,0 +1,56 @@
+package render
+
+import (
+	"sort"
+	"strconv"
+
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/parser"
+	"github.com/yuin/goldmark/text"
+	"github.com/yuin/goldmark/util"
+)
+
+// Goldmark extension that adds the source line to blocks as a data-line
+// attribute, like GemtextToHTML does.
+var SourceLines = &sourceLinesExtension{}
+
+type sourceLinesTransformer struct{}
+
+func (t *sourceLinesTransformer) Transform(doc *ast.Document, reader text.Reader, pc parser.Context) {
+	source := reader.Source()
+	starts := []int{0}
+	for i, c := range source {
+		if c == '\n' {
+			starts = append(starts, i+1)
+		}
+	}
+	ast.Walk(doc, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		if !entering || n.Type() != ast.TypeBlock || n.Kind() == ast.KindDocument {
+			return ast.WalkContinue, nil
+		}
+		if offset, ok := blockOffset(n); ok {
+			line := sort.Search(len(starts), func(i int) bool { return starts[i] > offset })
+			n.SetAttributeString("data-line", []byte(strconv.Itoa(line)))
+		}
+		return ast.WalkContinue, nil
+	})
+}
+
+// Returns the source offset of the first line of a block. Container blocks
+// (e.g. lists) start at their first child.
+func blockOffset(n ast.Node) (int, bool) {
+	for n != nil && n.Type() == ast.TypeBlock {
+		if n.Lines().Len() > 0 {
+			return n.Lines().At(0).Start, true
+		}
+		n = n.FirstChild()
+	}
+	return 0, false
+}
+
+type sourceLinesExtension struct{}
+
+func (e *sourceLinesExtension) Extend(m goldmark.Markdown) {
+	m.Parser().AddOptions(parser.WithASTTransformers(util.Prioritized(&sourceLinesTransformer{}, 200)))
+}
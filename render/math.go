@@ -0,0 +1,199 @@
+package render
+
+import (
+	"bytes"
+	"html"
+
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/parser"
+	"github.com/yuin/goldmark/renderer"
+	"github.com/yuin/goldmark/text"
+	"github.com/yuin/goldmark/util"
+)
+
+// Goldmark extension that keeps $...$ (inline) and $$...$$ (display) math
+// away from the markdown parser, and renders it as TeX source in elements
+// with class "math", which script.js typesets.
+var Math = &mathExtension{}
+
+var (
+	kindMathInline = ast.NewNodeKind("MathInline")
+	kindMathBlock  = ast.NewNodeKind("MathBlock")
+)
+
+type mathInline struct {
+	ast.BaseInline
+	display bool
+}
+
+func (n *mathInline) Kind() ast.NodeKind {
+	return kindMathInline
+}
+
+func (n *mathInline) Dump(source []byte, level int) {
+	ast.DumpHelper(n, source, level, nil, nil)
+}
+
+type mathBlock struct {
+	ast.BaseBlock
+}
+
+func (n *mathBlock) Kind() ast.NodeKind {
+	return kindMathBlock
+}
+
+func (n *mathBlock) IsRaw() bool {
+	return true
+}
+
+func (n *mathBlock) Dump(source []byte, level int) {
+	ast.DumpHelper(n, source, level, nil, nil)
+}
+
+// Parses $...$ and $$...$$ on a single line.
+// To avoid treating amounts ("$5 and $6") as math, the opening $ can't be
+// followed by a space, and the closing $ can't be preceded by a space or
+// followed by a digit.
+type mathInlineParser struct{}
+
+func (p *mathInlineParser) Trigger() []byte {
+	return []byte{'$'}
+}
+
+// End of the last line in which no closing $ or $$ was found, to avoid
+// scanning the rest of the line again for every following $.
+var mathUnclosedKeys = [3]parser.ContextKey{1: parser.NewContextKey(), 2: parser.NewContextKey()}
+
+func (p *mathInlineParser) Parse(parent ast.Node, block text.Reader, pc parser.Context) ast.Node {
+	line, segment := block.PeekLine()
+	delim := 1
+	if len(line) > 1 && line[1] == '$' {
+		delim = 2
+	}
+	if len(line) <= delim || util.IsSpace(line[delim]) {
+		return nil
+	}
+	if stop, ok := pc.Get(mathUnclosedKeys[delim]).(int); ok && stop == segment.Stop {
+		return nil
+	}
+	for i := delim; i < len(line); i++ {
+		switch {
+		case line[i] == '\\':
+			i++
+		case line[i] != '$':
+		case delim == 2:
+			if i+1 < len(line) && line[i+1] == '$' {
+				return p.node(block, segment, delim, i)
+			}
+		case !util.IsSpace(line[i-1]) && (i+1 >= len(line) || !util.IsNumeric(line[i+1])):
+			return p.node(block, segment, delim, i)
+		}
+	}
+	pc.Set(mathUnclosedKeys[delim], segment.Stop)
+	return nil
+}
+
+func (p *mathInlineParser) node(block text.Reader, segment text.Segment, delim int, end int) ast.Node {
+	node := &mathInline{display: delim == 2}
+	node.AppendChild(node, ast.NewRawTextSegment(text.NewSegment(segment.Start+delim, segment.Start+end)))
+	block.Advance(end + delim)
+	return node
+}
+
+// Parses display math between lines containing only $$.
+type mathBlockParser struct{}
+
+func (b *mathBlockParser) Trigger() []byte {
+	return []byte{'$'}
+}
+
+func (b *mathBlockParser) Open(parent ast.Node, reader text.Reader, pc parser.Context) (ast.Node, parser.State) {
+	line, segment := reader.PeekLine()
+	pos := pc.BlockOffset()
+	if pos < 0 || !isMathFence(line[pos:]) {
+		return nil, parser.NoChildren
+	}
+	reader.Advance(segment.Len() - newlineLen(line))
+	return &mathBlock{}, parser.NoChildren
+}
+
+func (b *mathBlockParser) Continue(node ast.Node, reader text.Reader, pc parser.Context) parser.State {
+	line, segment := reader.PeekLine()
+	if isMathFence(util.TrimLeftSpace(line)) {
+		reader.Advance(segment.Len() - newlineLen(line))
+		return parser.Close
+	}
+	node.Lines().Append(segment)
+	reader.Advance(segment.Len() - 1)
+	return parser.Continue | parser.NoChildren
+}
+
+func (b *mathBlockParser) Close(node ast.Node, reader text.Reader, pc parser.Context) {}
+
+func (b *mathBlockParser) CanInterruptParagraph() bool {
+	return true
+}
+
+func (b *mathBlockParser) CanAcceptIndentedLine() bool {
+	return false
+}
+
+// The last line of the file has no newline
+func newlineLen(line []byte) int {
+	if bytes.HasSuffix(line, []byte("\n")) {
+		return 1
+	}
+	return 0
+}
+
+func isMathFence(line []byte) bool {
+	return bytes.HasPrefix(line, []byte("$$")) && util.IsBlank(line[2:])
+}
+
+type mathRenderer struct{}
+
+func (r *mathRenderer) RegisterFuncs(reg renderer.NodeRendererFuncRegisterer) {
+	reg.Register(kindMathInline, r.renderInline)
+	reg.Register(kindMathBlock, r.renderBlock)
+}
+
+func (r *mathRenderer) renderInline(w util.BufWriter, source []byte, n ast.Node, entering bool) (ast.WalkStatus, error) {
+	if !entering {
+		return ast.WalkContinue, nil
+	}
+	if n.(*mathInline).display {
+		w.WriteString(`<span class="math display">`)
+	} else {
+		w.WriteString(`<span class="math inline">`)
+	}
+	for c := n.FirstChild(); c != nil; c = c.NextSibling() {
+		w.WriteString(html.EscapeString(string(c.(*ast.Text).Segment.Value(source))))
+	}
+	w.WriteString("</span>")
+	return ast.WalkSkipChildren, nil
+}
+
+func (r *mathRenderer) renderBlock(w util.BufWriter, source []byte, n ast.Node, entering bool) (ast.WalkStatus, error) {
+	if entering {
+		w.WriteString(`<div class="math display">`)
+		lines := n.Lines()
+		for i := 0; i < lines.Len(); i++ {
+			line := lines.At(i)
+			w.WriteString(html.EscapeString(string(line.Value(source))))
+		}
+	} else {
+		w.WriteString("</div>\n")
+	}
+	return ast.WalkContinue, nil
+}
+
+type mathExtension struct{}
+
+func (e *mathExtension) Extend(m goldmark.Markdown) {
+	m.Parser().AddOptions(
+		parser.WithBlockParsers(util.Prioritized(&mathBlockParser{}, 700)),
+		parser.WithInlineParsers(util.Prioritized(&mathInlineParser{}, 500)),
+	)
+	m.Renderer().AddOptions(renderer.WithNodeRenderers(util.Prioritized(&mathRenderer{}, 100)))
+}
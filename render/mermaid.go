@@ -0,0 +1,81 @@
+package render
+
+import (
+	"bytes"
+	"html"
+
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/parser"
+	"github.com/yuin/goldmark/renderer"
+	"github.com/yuin/goldmark/text"
+	"github.com/yuin/goldmark/util"
+)
+
+// Goldmark extension that renders ```mermaid fenced code blocks as
+// <div class="mermaid">, which script.js turns into diagrams.
+var Mermaid = &mermaidExtension{}
+
+var kindMermaid = ast.NewNodeKind("Mermaid")
+
+type mermaidBlock struct {
+	ast.BaseBlock
+}
+
+func (n *mermaidBlock) Kind() ast.NodeKind {
+	return kindMermaid
+}
+
+func (n *mermaidBlock) IsRaw() bool {
+	return true
+}
+
+func (n *mermaidBlock) Dump(source []byte, level int) {
+	ast.DumpHelper(n, source, level, nil, nil)
+}
+
+type mermaidTransformer struct{}
+
+func (t *mermaidTransformer) Transform(doc *ast.Document, reader text.Reader, pc parser.Context) {
+	var blocks []*ast.FencedCodeBlock
+	ast.Walk(doc, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		if b, ok := n.(*ast.FencedCodeBlock); ok && entering {
+			if bytes.Equal(b.Language(reader.Source()), []byte("mermaid")) {
+				blocks = append(blocks, b)
+			}
+		}
+		return ast.WalkContinue, nil
+	})
+	for _, b := range blocks {
+		m := &mermaidBlock{}
+		m.SetLines(b.Lines())
+		b.Parent().ReplaceChild(b.Parent(), b, m)
+	}
+}
+
+type mermaidRenderer struct{}
+
+func (r *mermaidRenderer) RegisterFuncs(reg renderer.NodeRendererFuncRegisterer) {
+	reg.Register(kindMermaid, r.render)
+}
+
+func (r *mermaidRenderer) render(w util.BufWriter, source []byte, n ast.Node, entering bool) (ast.WalkStatus, error) {
+	if entering {
+		w.WriteString(`<div class="mermaid">`)
+		lines := n.Lines()
+		for i := 0; i < lines.Len(); i++ {
+			line := lines.At(i)
+			w.WriteString(html.EscapeString(string(line.Value(source))))
+		}
+	} else {
+		w.WriteString("</div>\n")
+	}
+	return ast.WalkContinue, nil
+}
+
+type mermaidExtension struct{}
+
+func (e *mermaidExtension) Extend(m goldmark.Markdown) {
+	m.Parser().AddOptions(parser.WithASTTransformers(util.Prioritized(&mermaidTransformer{}, 100)))
+	m.Renderer().AddOptions(renderer.WithNodeRenderers(util.Prioritized(&mermaidRenderer{}, 100)))
+}
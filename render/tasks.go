@@ -0,0 +1,61 @@
+package render
+
+import (
+	"strconv"
+
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	extast "github.com/yuin/goldmark/extension/ast"
+	"github.com/yuin/goldmark/parser"
+	"github.com/yuin/goldmark/renderer"
+	gmhtml "github.com/yuin/goldmark/renderer/html"
+	"github.com/yuin/goldmark/text"
+	"github.com/yuin/goldmark/util"
+)
+
+// Goldmark extension that numbers the check boxes of task list items with a
+// data-task attribute, in the same order as SetTask. The viewer sends this
+// index back, as it can't count the boxes itself (e.g. loose list items put
+// them in a paragraph, and raw HTML can contain other check boxes).
+var TaskIndexes = &taskIndexesExtension{}
+
+type taskIndexesTransformer struct{}
+
+func (t *taskIndexesTransformer) Transform(doc *ast.Document, reader text.Reader, pc parser.Context) {
+	index := 0
+	ast.Walk(doc, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		if _, ok := n.(*extast.TaskCheckBox); ok && entering {
+			n.SetAttributeString("data-task", []byte(strconv.Itoa(index)))
+			index++
+		}
+		return ast.WalkContinue, nil
+	})
+}
+
+// Renders check boxes like goldmark, with their attributes
+type taskIndexesRenderer struct{}
+
+func (r *taskIndexesRenderer) RegisterFuncs(reg renderer.NodeRendererFuncRegisterer) {
+	reg.Register(extast.KindTaskCheckBox, r.render)
+}
+
+func (r *taskIndexesRenderer) render(w util.BufWriter, source []byte, n ast.Node, entering bool) (ast.WalkStatus, error) {
+	if !entering {
+		return ast.WalkContinue, nil
+	}
+	if n.(*extast.TaskCheckBox).IsChecked {
+		w.WriteString(`<input checked="" disabled="" type="checkbox"`)
+	} else {
+		w.WriteString(`<input disabled="" type="checkbox"`)
+	}
+	gmhtml.RenderAttributes(w, n, nil)
+	w.WriteString("> ")
+	return ast.WalkContinue, nil
+}
+
+type taskIndexesExtension struct{}
+
+func (e *taskIndexesExtension) Extend(m goldmark.Markdown) {
+	m.Parser().AddOptions(parser.WithASTTransformers(util.Prioritized(&taskIndexesTransformer{}, 100)))
+	m.Renderer().AddOptions(renderer.WithNodeRenderers(util.Prioritized(&taskIndexesRenderer{}, 100)))
+}
@@ -0,0 +1,249 @@
+package render
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/yuin/goldmark/ast"
+	extast "github.com/yuin/goldmark/extension/ast"
+	"github.com/yuin/goldmark/text"
+	"github.com/yuin/goldmark/util"
+)
+
+// Converts markdown to Gemtext. Gemtext can't express everything markdown
+// can, so the conversion is lossy:
+//   - Inline formatting (emphasis, code spans, ...) is dropped, keeping the text.
+//   - Links and images can't be inline, so they are written as link lines
+//     after the block they are in.
+//   - Figures (images with a title on their own) become a link line, with the
+//     title as label.
+//   - Headings deeper than 3 levels become level 3 headings.
+//   - Nested lists are flattened.
+//   - Tables become preformatted blocks, with cells separated by |.
+//   - Raw HTML is dropped.
+//   - Lines of text that would be read as Gemtext markup start with a space.
+func MarkdownToGemtext(input []byte, opts Options, w io.Writer) error {
+	c := NewConverter(FormatMarkdown, opts)
+	doc := c.md.Parser().Parse(text.NewReader(input))
+	g := &gemtextWriter{w: bufio.NewWriter(w), source: input}
+	first := true
+	for n := doc.FirstChild(); n != nil; n = n.NextSibling() {
+		if n.Kind() == ast.KindHTMLBlock {
+			continue
+		}
+		if !first {
+			g.w.WriteString("\n")
+		}
+		first = false
+		g.block(n)
+	}
+	return g.w.Flush()
+}
+
+type gemtextLink struct {
+	url   string
+	label string
+}
+
+type gemtextWriter struct {
+	w      *bufio.Writer
+	source []byte
+	links  []gemtextLink // Links of the current block
+}
+
+func (g *gemtextWriter) block(n ast.Node) {
+	switch n := n.(type) {
+	case *ast.Paragraph, *ast.TextBlock:
+		for _, line := range strings.Split(g.inline(n), "\n") {
+			g.textLine("", line)
+		}
+		g.flushLinks()
+	case *ast.Heading:
+		level := min(n.Level, 3)
+		fmt.Fprintf(g.w, "%s %s\n", strings.Repeat("#", level), strings.ReplaceAll(g.inline(n), "\n", " "))
+		g.flushLinks()
+	case *ast.List:
+		g.list(n, n.Start)
+		g.flushLinks()
+	case *ast.Blockquote:
+		first := true
+		for c := n.FirstChild(); c != nil; c = c.NextSibling() {
+			if !first {
+				g.w.WriteString(">\n")
+			}
+			first = false
+			for _, line := range strings.Split(g.inline(c), "\n") {
+				fmt.Fprintf(g.w, "> %s\n", line)
+			}
+		}
+		g.flushLinks()
+	case *ast.FencedCodeBlock:
+		g.pre(string(n.Language(g.source)), n)
+	case *ast.CodeBlock:
+		g.pre("", n)
+	case *ast.ThematicBreak:
+		g.w.WriteString("---\n")
+	case *figure:
+		img := n.FirstChild().(*ast.Image)
+		g.links = append(g.links, gemtextLink{url: string(img.Destination), label: string(unescapeMarkdown(img.Title))})
+		g.flushLinks()
+	case *extast.Footnote:
+		var texts []string
+		for c := n.FirstChild(); c != nil; c = c.NextSibling() {
+			texts = append(texts, strings.ReplaceAll(g.inline(c), "\n", " "))
+		}
+		g.textLine(fmt.Sprintf("[%d] ", n.Index), strings.Join(texts, " "))
+		g.flushLinks()
+	case *extast.Table:
+		g.w.WriteString("```\n")
+		for row := n.FirstChild(); row != nil; row = row.NextSibling() {
+			var cells []string
+			for cell := row.FirstChild(); cell != nil; cell = cell.NextSibling() {
+				cells = append(cells, g.inline(cell))
+			}
+			fmt.Fprintf(g.w, "%s\n", strings.Join(cells, " | "))
+		}
+		g.w.WriteString("```\n")
+		g.flushLinks()
+	default:
+		switch {
+		case n.Kind() == kindMermaid:
+			g.pre("mermaid", n)
+		case n.Kind() == kindMathBlock:
+			g.pre("math", n)
+		case n.HasChildren():
+			// Footnotes, definition lists, ...
+			for c := n.FirstChild(); c != nil; c = c.NextSibling() {
+				g.block(c)
+			}
+		}
+	}
+}
+
+// Writes the items of a list, and of the lists nested in it
+func (g *gemtextWriter) list(n *ast.List, start int) {
+	for item := n.FirstChild(); item != nil; item = item.NextSibling() {
+		var texts []string
+		for c := item.FirstChild(); c != nil; c = c.NextSibling() {
+			if _, ok := c.(*ast.List); !ok {
+				texts = append(texts, strings.ReplaceAll(g.inline(c), "\n", " "))
+			}
+		}
+		if n.IsOrdered() {
+			g.textLine(fmt.Sprintf("%d. ", start), strings.Join(texts, " "))
+			start++
+		} else {
+			fmt.Fprintf(g.w, "* %s\n", strings.Join(texts, " "))
+		}
+		for c := item.FirstChild(); c != nil; c = c.NextSibling() {
+			if l, ok := c.(*ast.List); ok {
+				g.list(l, l.Start)
+			}
+		}
+	}
+}
+
+func (g *gemtextWriter) pre(alt string, n ast.Node) {
+	fmt.Fprintf(g.w, "```%s\n", alt)
+	lines := n.Lines()
+	for i := 0; i < lines.Len(); i++ {
+		line := lines.At(i)
+		value := line.Value(g.source)
+		g.w.Write(value)
+		// The last line of the file has no newline
+		if !bytes.HasSuffix(value, []byte("\n")) {
+			g.w.WriteString("\n")
+		}
+	}
+	g.w.WriteString("```\n")
+}
+
+// Writes a line of text, making sure it isn't read as markup
+func (g *gemtextWriter) textLine(prefix string, line string) {
+	line = prefix + line
+	if strings.HasPrefix(line, "#") || strings.HasPrefix(line, "=>") || strings.HasPrefix(line, "* ") ||
+		strings.HasPrefix(line, ">") || strings.HasPrefix(line, "```") || isRule(line) {
+		line = " " + line
+	}
+	g.w.WriteString(line + "\n")
+}
+
+// Writes the links collected from the previous block
+func (g *gemtextWriter) flushLinks() {
+	for _, l := range g.links {
+		if l.label == "" || l.label == l.url {
+			fmt.Fprintf(g.w, "=> %s\n", l.url)
+		} else {
+			fmt.Fprintf(g.w, "=> %s %s\n", l.url, strings.ReplaceAll(l.label, "\n", " "))
+		}
+	}
+	g.links = nil
+}
+
+// Returns markdown text as it is shown, without backslash escapes and with
+// character references resolved
+func unescapeMarkdown(text []byte) []byte {
+	return util.ResolveEntityNames(util.ResolveNumericReferences(util.UnescapePunctuations(text)))
+}
+
+// Returns the text of the inline content of n, with hard line breaks as
+// newlines, and collects its links.
+func (g *gemtextWriter) inline(n ast.Node) string {
+	var s strings.Builder
+	walk := func(c ast.Node, entering bool) (ast.WalkStatus, error) {
+		if !entering {
+			return ast.WalkContinue, nil
+		}
+		switch c := c.(type) {
+		case *ast.Text:
+			s.Write(unescapeMarkdown(c.Segment.Value(g.source)))
+			if c.HardLineBreak() {
+				s.WriteString("\n")
+			} else if c.SoftLineBreak() {
+				s.WriteString(" ")
+			}
+		case *ast.String:
+			s.Write(c.Value)
+		case *ast.CodeSpan:
+			// Code is literal, without escapes
+			for t := c.FirstChild(); t != nil; t = t.NextSibling() {
+				if t, ok := t.(*ast.Text); ok {
+					s.WriteString(strings.ReplaceAll(string(t.Segment.Value(g.source)), "\n", " "))
+				}
+			}
+			return ast.WalkSkipChildren, nil
+		case *ast.AutoLink:
+			s.Write(c.Label(g.source))
+			g.links = append(g.links, gemtextLink{url: string(c.URL(g.source))})
+			return ast.WalkSkipChildren, nil
+		case *ast.Link:
+			label := g.inline(c)
+			s.WriteString(label)
+			g.links = append(g.links, gemtextLink{url: string(c.Destination), label: label})
+			return ast.WalkSkipChildren, nil
+		case *ast.Image:
+			label := g.inline(c)
+			s.WriteString(label)
+			g.links = append(g.links, gemtextLink{url: string(c.Destination), label: label})
+			return ast.WalkSkipChildren, nil
+		case *ast.RawHTML:
+			return ast.WalkSkipChildren, nil
+		case *extast.FootnoteLink:
+			fmt.Fprintf(&s, "[%d]", c.Index)
+		case *extast.TaskCheckBox:
+			if c.IsChecked {
+				s.WriteString("[x] ")
+			} else {
+				s.WriteString("[ ] ")
+			}
+		}
+		return ast.WalkContinue, nil
+	}
+	for c := n.FirstChild(); c != nil; c = c.NextSibling() {
+		ast.Walk(c, walk)
+	}
+	return s.String()
+}
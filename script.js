@@ -1,7 +1,36 @@
-/* global openURL, quit, onReady */
+/* global openURL, quit, onReady, reload, setGeometry, setTask, setFontSize, back, selectTab, closeTab, loadImage, getSource, saveTheme */
 
 const contentEl = document.getElementById("content");
 
+// Same as in main.go. "auto" follows the system setting through
+// prefers-color-scheme.
+const themes = ["auto", "light", "dark", "github", "solarized", "sepia"];
+const darkThemes = ["dark"];
+let currentTheme = document.body.dataset.theme;
+
+// The theme is a class of the body, which selects the colors in style.css
+function setTheme(theme) {
+  for (const t of themes) {
+    document.body.classList.toggle(t, t === theme);
+  }
+  currentTheme = theme;
+}
+setTheme(currentTheme);
+
+// Switches to the next theme, which is remembered for the next run
+function nextTheme() {
+  const theme = themes[(themes.indexOf(currentTheme) + 1) % themes.length];
+  setTheme(theme);
+  saveTheme(theme);
+}
+
+function isDark() {
+  if (currentTheme === "auto") {
+    return window.matchMedia("(prefers-color-scheme: dark)").matches;
+  }
+  return darkThemes.includes(currentTheme);
+}
+
 function isElementInView(el) {
   var rect = el.getBoundingClientRect();
   return (
@@ -13,9 +42,708 @@ function isElementInView(el) {
   );
 }
 
+function topVisibleLine() {
+  for (const el of contentEl.querySelectorAll("[data-line]")) {
+    const rect = el.getBoundingClientRect();
+    if (rect.bottom > 0) {
+      return { line: parseInt(el.dataset.line), top: rect.top };
+    }
+  }
+  return null;
+}
+
+// Scrolls the element with the closest line at or before `pos.line` back to
+// where it was. Falls back to the previous scroll offset when there are no
+// line annotations.
+function restoreScroll(pos, scrollY) {
+  if (pos != null) {
+    let target = null;
+    for (const el of contentEl.querySelectorAll("[data-line]")) {
+      if (parseInt(el.dataset.line) > pos.line) {
+        break;
+      }
+      target = el;
+    }
+    if (target != null) {
+      window.scrollBy(0, target.getBoundingClientRect().top - pos.top);
+      return;
+    }
+  }
+  window.scrollTo(0, scrollY);
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// Font size
+////////////////////////////////////////////////////////////////////////////////
+
+const minFontSize = 8;
+const maxFontSize = 48;
+
+function changeFontSize(delta) {
+  const size = parseInt(getComputedStyle(document.body).fontSize);
+  const newSize = Math.min(Math.max(size + delta, minFontSize), maxFontSize);
+  document.body.style.setProperty("--font-size", newSize + "px");
+  setFontSize(newSize);
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// Content updates
+////////////////////////////////////////////////////////////////////////////////
+
+// Returns a copy of the node without line numbers and change marks, to
+// compare it with the same block of another render.
+function normalizedNode(node) {
+  const copy = node.cloneNode(true);
+  if (copy.nodeType !== Node.ELEMENT_NODE) {
+    return copy;
+  }
+  for (const el of [copy, ...copy.querySelectorAll("[data-line]")]) {
+    el.removeAttribute("data-line");
+  }
+  for (const el of copy.querySelectorAll("[data-task]")) {
+    el.removeAttribute("data-task");
+  }
+  for (const el of [copy, ...copy.querySelectorAll(".changed")]) {
+    el.classList.remove("changed");
+    if (el.classList.length === 0) {
+      el.removeAttribute("class");
+    }
+  }
+  return copy;
+}
+
+// Copies the line numbers and task indexes of a new render of a block onto
+// the old one
+function updateLines(el, from) {
+  if (el.nodeType !== Node.ELEMENT_NODE) {
+    return;
+  }
+  const els = [el, ...el.querySelectorAll("[data-line]")];
+  const froms = [from, ...from.querySelectorAll("[data-line]")];
+  els.forEach((el, i) => {
+    if (froms[i] != null && froms[i].dataset.line != null) {
+      el.dataset.line = froms[i].dataset.line;
+    }
+  });
+  const boxes = el.querySelectorAll("[data-task]");
+  from.querySelectorAll("[data-task]").forEach((box, i) => {
+    boxes[i].dataset.task = box.dataset.task;
+  });
+}
+
+// Replaces the content, keeping the top-level blocks that didn't change, so
+// their scroll position, selection, and rendered diagrams and math survive.
+// Unless the converter already marked changed blocks (Gemtext), new blocks
+// are marked here, except when nothing was kept (i.e. a different document).
+function updateContent(s) {
+  const tmpl = document.createElement("template");
+  tmpl.innerHTML = s;
+  const marked = tmpl.content.querySelector(".changed") != null;
+  const oldNodes = Array.from(contentEl.childNodes);
+  const nodes = [];
+  const added = [];
+  let kept = 0;
+  let i = 0;
+  for (const node of Array.from(tmpl.content.childNodes)) {
+    const key = normalizedNode(node);
+    let k = i;
+    while (
+      k < oldNodes.length &&
+      !(oldNodes[k].key != null && oldNodes[k].key.isEqualNode(key))
+    ) {
+      k++;
+    }
+    if (k < oldNodes.length) {
+      const old = oldNodes[k];
+      if (old.nodeType === Node.ELEMENT_NODE) {
+        old.classList.remove("changed");
+        kept++;
+      }
+      updateLines(old, node);
+      nodes.push(old);
+      i = k + 1;
+    } else {
+      node.key = key;
+      nodes.push(node);
+      added.push(node);
+    }
+  }
+  contentEl.textContent = "";
+  for (const node of nodes) {
+    contentEl.appendChild(node);
+  }
+  if (!marked && kept > 0) {
+    for (const node of added) {
+      if (node.nodeType === Node.ELEMENT_NODE) {
+        node.classList.add("changed");
+      }
+    }
+  }
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// Tabs
+////////////////////////////////////////////////////////////////////////////////
+
+const tabsEl = document.getElementById("tabs");
+let tabCount = 1;
+let currentTab = 0;
+
+// The tab bar is only shown when there is more than one document
+// eslint-disable-next-line no-unused-vars
+function setTabs(names, current) {
+  tabCount = names.length;
+  currentTab = current;
+  tabsEl.innerHTML = "";
+  names.forEach((name, index) => {
+    const el = document.createElement("div");
+    el.className = "tab";
+    el.classList.toggle("current", index === current);
+    el.title = name;
+    const label = document.createElement("span");
+    label.textContent = name;
+    label.addEventListener("click", () => selectTab(index));
+    const close = document.createElement("button");
+    close.textContent = "×";
+    close.title = "Close (Ctrl+W)";
+    close.addEventListener("click", () => closeTab(index));
+    el.appendChild(label);
+    el.appendChild(close);
+    tabsEl.appendChild(el);
+  });
+  tabsEl.hidden = names.length < 2;
+}
+
+function nextTab(delta) {
+  if (tabCount > 1) {
+    selectTab((currentTab + delta + tabCount) % tabCount);
+  }
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// Table of contents
+////////////////////////////////////////////////////////////////////////////////
+
+const tocEl = document.getElementById("toc");
+const tocListEl = tocEl.querySelector("ul");
+
+function updateTOC() {
+  tocListEl.innerHTML = "";
+  for (const h of contentEl.querySelectorAll("h1, h2, h3, h4, h5, h6")) {
+    if (!h.id) {
+      continue;
+    }
+    const a = document.createElement("a");
+    a.href = "#" + h.id;
+    a.textContent = h.textContent;
+    const li = document.createElement("li");
+    li.className = "toc-" + h.tagName.toLowerCase();
+    li.appendChild(a);
+    tocListEl.appendChild(li);
+  }
+  tocEl.classList.toggle("empty", tocListEl.children.length === 0);
+}
+
+function toggleTOC() {
+  document.body.classList.toggle("toc-open");
+}
+
+document.getElementById("toc-toggle").addEventListener("click", toggleTOC);
+
+////////////////////////////////////////////////////////////////////////////////
+// Copying
+////////////////////////////////////////////////////////////////////////////////
+
+// The clipboard API isn't available everywhere in the webview
+function copyText(text) {
+  if (navigator.clipboard != null) {
+    return navigator.clipboard.writeText(text);
+  }
+  const el = document.createElement("textarea");
+  el.value = text;
+  document.body.appendChild(el);
+  el.select();
+  document.execCommand("copy");
+  el.remove();
+  return Promise.resolve();
+}
+
+// Creates a button that copies the text from `getText`, and briefly shows it
+// has done so. The label comes from CSS, so it's not part of the content text.
+function copyButton(className, title, getText) {
+  const button = document.createElement("button");
+  button.className = "copy " + className;
+  button.title = title;
+  button.setAttribute("aria-label", title);
+  button.addEventListener("click", (ev) => {
+    ev.stopPropagation();
+    copyText(getText()).then(() => {
+      button.classList.add("copied");
+      setTimeout(() => button.classList.remove("copied"), 1000);
+    });
+  });
+  return button;
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// Headings
+////////////////////////////////////////////////////////////////////////////////
+
+// In the webview, the anchor is copied as a link for within the document.
+function anchorURL(id) {
+  if (location.protocol.startsWith("http")) {
+    return location.href.replace(/#.*$/, "") + "#" + id;
+  }
+  return "#" + id;
+}
+
+function updateHeadings() {
+  for (const h of contentEl.querySelectorAll(
+    "h1[id], h2[id], h3[id], h4[id], h5[id], h6[id]",
+  )) {
+    if (h.querySelector(".anchor") == null) {
+      h.appendChild(
+        copyButton("anchor", "Copy link to section", () => anchorURL(h.id)),
+      );
+    }
+  }
+}
+
+// Scrolls to the next (delta 1) or previous (delta -1) heading of the
+// content, wrapping around at the ends.
+function scrollToHeading(delta) {
+  const headings = Array.from(
+    contentEl.querySelectorAll("h1, h2, h3, h4, h5, h6"),
+  );
+  if (headings.length === 0) {
+    return;
+  }
+  // Headings scrolled to end up at the top, give or take rounding. At the
+  // bottom, the next ones can't get there.
+  const tops = headings.map((h) => h.getBoundingClientRect().top);
+  const atBottom =
+    window.innerHeight + window.scrollY >=
+    document.documentElement.scrollHeight - 1;
+  let index;
+  if (delta > 0) {
+    index = tops.findIndex((top) => top > 1);
+    if (index < 0 || atBottom) {
+      index = 0;
+    }
+  } else {
+    index = -1;
+    tops.forEach((top, i) => {
+      if (top < -1) {
+        index = i;
+      }
+    });
+    if (index < 0) {
+      index = headings.length - 1;
+    }
+  }
+  headings[index].scrollIntoView();
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// Images
+////////////////////////////////////////////////////////////////////////////////
+
+// The page can't load local files, so relative images are loaded through
+// the application. Images of kept blocks are already loaded.
+function updateImages() {
+  for (const img of contentEl.querySelectorAll("img[src]:not([data-src])")) {
+    const src = img.getAttribute("src");
+    if (/^([a-z][a-z0-9+.-]*:|\/\/)/i.test(src)) {
+      continue;
+    }
+    img.dataset.src = src;
+    loadImage(src).then(
+      (url) => (img.src = url),
+      (e) => console.error(e),
+    );
+  }
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// Source view
+////////////////////////////////////////////////////////////////////////////////
+
+const sourceEl = document.getElementById("source");
+
+// The source is fetched when shown, and again on every render while shown
+function updateSource() {
+  if (sourceEl.hidden) {
+    return;
+  }
+  getSource().then(
+    (s) => (sourceEl.textContent = s),
+    (e) => (sourceEl.textContent = String(e)),
+  );
+}
+
+function toggleSource() {
+  sourceEl.hidden = !sourceEl.hidden;
+  contentEl.hidden = !sourceEl.hidden;
+  window.scrollTo(0, 0);
+  updateSource();
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// Task lists
+////////////////////////////////////////////////////////////////////////////////
+
+const editable = document.body.dataset.edit === "true";
+
+// Check boxes are numbered by the converter, in the order the application
+// edits them. Loose list items have them in a paragraph.
+function taskBoxes() {
+  return contentEl.querySelectorAll("input[type=checkbox][data-task]");
+}
+
+function updateTasks() {
+  for (const box of taskBoxes()) {
+    const item = box.closest("li");
+    if (item != null) {
+      item.classList.add("task");
+    }
+    if (editable) {
+      box.disabled = false;
+    }
+  }
+}
+
+contentEl.addEventListener("change", (ev) => {
+  const index = ev.target.dataset.task;
+  if (editable && index != null) {
+    setTask(Number(index), ev.target.checked);
+  }
+});
+
+////////////////////////////////////////////////////////////////////////////////
+// Code blocks
+////////////////////////////////////////////////////////////////////////////////
+
+const showLineNumbers = document.body.dataset.lineNumbers === "true";
+
+// Puts every line of the code blocks in a span, which gets its number
+// through a CSS counter. Generated content is not copied along with the code.
+function addLineNumbers() {
+  for (const pre of contentEl.querySelectorAll("pre:not(.line-numbers)")) {
+    const code = pre.querySelector("code") || pre;
+    const lines = code.textContent.replace(/\n$/, "").split("\n");
+    code.textContent = "";
+    for (const line of lines) {
+      const span = document.createElement("span");
+      span.className = "line";
+      span.textContent = line + "\n";
+      code.appendChild(span);
+    }
+    pre.classList.add("line-numbers");
+  }
+}
+
+function addCopyButtons() {
+  for (const pre of contentEl.querySelectorAll("pre")) {
+    if (pre.querySelector(".copy") == null) {
+      const code = pre.querySelector("code") || pre;
+      pre.appendChild(
+        copyButton("copy-code", "Copy code", () =>
+          code.textContent.replace(/\n$/, ""),
+        ),
+      );
+    }
+  }
+}
+
+function updateCodeBlocks() {
+  if (showLineNumbers) {
+    addLineNumbers();
+  }
+  addCopyButtons();
+}
+
+// Clicking the caption of a Gemtext preformatted block hides it
+contentEl.addEventListener("click", (ev) => {
+  const caption = ev.target.closest("figure.preformatted > figcaption");
+  if (caption != null) {
+    caption.parentNode.classList.toggle("collapsed");
+  }
+});
+
+////////////////////////////////////////////////////////////////////////////////
+// Diagrams
+////////////////////////////////////////////////////////////////////////////////
+
+// Mermaid is big, so it is only loaded when a document has diagrams
+const mermaidURL = "https://cdn.jsdelivr.net/npm/mermaid@10.9.1/dist/mermaid.min.js";
+let mermaidLoad = null;
+
+function loadMermaid() {
+  if (mermaidLoad == null) {
+    mermaidLoad = new Promise((resolve, reject) => {
+      const el = document.createElement("script");
+      el.src = mermaidURL;
+      el.onload = resolve;
+      el.onerror = reject;
+      document.head.appendChild(el);
+    });
+  }
+  return mermaidLoad;
+}
+
+async function renderDiagrams() {
+  const nodes = contentEl.querySelectorAll(".mermaid:not([data-processed])");
+  if (nodes.length === 0) {
+    return;
+  }
+  try {
+    await loadMermaid();
+  } catch (e) {
+    console.error("unable to load mermaid");
+    return;
+  }
+  window.mermaid.initialize({
+    startOnLoad: false,
+    theme: isDark() ? "dark" : "default",
+  });
+  await window.mermaid.run({ nodes });
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// Math
+////////////////////////////////////////////////////////////////////////////////
+
+// Like mermaid, KaTeX is only loaded when a document has math
+const katexURL = "https://cdn.jsdelivr.net/npm/katex@0.16.9/dist/";
+let katexLoad = null;
+
+function loadKaTeX() {
+  if (katexLoad == null) {
+    const css = document.createElement("link");
+    css.rel = "stylesheet";
+    css.href = katexURL + "katex.min.css";
+    document.head.appendChild(css);
+    katexLoad = new Promise((resolve, reject) => {
+      const el = document.createElement("script");
+      el.src = katexURL + "katex.min.js";
+      el.onload = resolve;
+      el.onerror = reject;
+      document.head.appendChild(el);
+    });
+  }
+  return katexLoad;
+}
+
+async function renderMath() {
+  const nodes = contentEl.querySelectorAll(".math:not([data-tex])");
+  if (nodes.length === 0) {
+    return;
+  }
+  try {
+    await loadKaTeX();
+  } catch (e) {
+    console.error("unable to load KaTeX");
+    return;
+  }
+  for (const el of nodes) {
+    el.dataset.tex = el.textContent;
+    window.katex.render(el.dataset.tex, el, {
+      displayMode: el.classList.contains("display"),
+      throwOnError: false,
+    });
+  }
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// Search
+////////////////////////////////////////////////////////////////////////////////
+
+const searchEl = document.getElementById("search");
+const searchInputEl = searchEl.querySelector("input");
+const searchCountEl = searchEl.querySelector(".count");
+let searchMatches = [];
+let searchIndex = 0;
+
+function clearSearchMatches() {
+  for (const mark of searchMatches) {
+    mark.replaceWith(mark.textContent);
+  }
+  searchMatches = [];
+  contentEl.normalize();
+}
+
+// Wraps all (case insensitive) occurrences of the query in a <mark>
+function findSearchMatches(query) {
+  clearSearchMatches();
+  if (query === "") {
+    return;
+  }
+  query = query.toLowerCase();
+  const walker = document.createTreeWalker(contentEl, NodeFilter.SHOW_TEXT);
+  const nodes = [];
+  while (walker.nextNode()) {
+    nodes.push(walker.currentNode);
+  }
+  for (let node of nodes) {
+    let i;
+    while ((i = node.data.toLowerCase().indexOf(query)) >= 0) {
+      const match = node.splitText(i);
+      node = match.splitText(query.length);
+      const mark = document.createElement("mark");
+      mark.className = "search-match";
+      match.replaceWith(mark);
+      mark.appendChild(match);
+      searchMatches.push(mark);
+    }
+  }
+}
+
+function showSearchMatch(index, scroll) {
+  for (const mark of searchMatches) {
+    mark.classList.remove("current");
+  }
+  if (searchMatches.length === 0) {
+    searchIndex = 0;
+    searchCountEl.textContent = searchInputEl.value === "" ? "" : "0/0";
+    return;
+  }
+  searchIndex = (index + searchMatches.length) % searchMatches.length;
+  const mark = searchMatches[searchIndex];
+  mark.classList.add("current");
+  if (scroll) {
+    mark.scrollIntoView({ block: "center" });
+  }
+  searchCountEl.textContent = `${searchIndex + 1}/${searchMatches.length}`;
+}
+
+function openSearch() {
+  searchEl.hidden = false;
+  searchInputEl.focus();
+  searchInputEl.select();
+}
+
+function closeSearch() {
+  searchEl.hidden = true;
+  clearSearchMatches();
+  searchCountEl.textContent = "";
+}
+
+// Re-applies the search after the content was replaced
+function updateSearch() {
+  if (!searchEl.hidden) {
+    findSearchMatches(searchInputEl.value);
+    showSearchMatch(searchIndex, false);
+  }
+}
+
+searchInputEl.addEventListener("input", () => {
+  findSearchMatches(searchInputEl.value);
+  showSearchMatch(0, true);
+});
+
+searchInputEl.addEventListener("keydown", (ev) => {
+  if (ev.key === "Enter") {
+    ev.preventDefault();
+    showSearchMatch(searchIndex + (ev.shiftKey ? -1 : 1), true);
+  } else if (ev.key === "Escape") {
+    ev.preventDefault();
+    closeSearch();
+  }
+});
+
+////////////////////////////////////////////////////////////////////////////////
+
+const userStyleEl = document.getElementById("user-style");
+const errorEl = document.getElementById("error");
+
+// Shows a render error, or hides it when empty
+// eslint-disable-next-line no-unused-vars
+function setError(msg) {
+  errorEl.textContent = msg;
+  errorEl.hidden = msg === "";
+}
+
+const statusEl = document.getElementById("status");
+const statusSourceEl = statusEl.querySelector(".source");
+const statusInfoEl = statusEl.querySelector(".info");
+let statusWords = "";
+let statusTime = "";
+
+function updateStatus() {
+  statusInfoEl.textContent = [statusWords, statusTime]
+    .filter((s) => s !== "")
+    .join(" · ");
+}
+
+const wordsPerMinute = 200;
+
+// eslint-disable-next-line no-unused-vars
+function setWordCount(words) {
+  const minutes = Math.max(1, Math.round(words / wordsPerMinute));
+  statusWords = `${words} words · ${minutes} min read`;
+  updateStatus();
+}
+
+// Shows the source path, and the time of the last render (in milliseconds
+// since the epoch)
+// eslint-disable-next-line no-unused-vars
+function setStatus(path, time) {
+  statusSourceEl.textContent = path;
+  statusSourceEl.title = path;
+  statusTime = "rendered " + new Date(time).toLocaleTimeString();
+  updateStatus();
+}
+
+// eslint-disable-next-line no-unused-vars
+function setStyle(s) {
+  if (userStyleEl.textContent !== s) {
+    userStyleEl.textContent = s;
+  }
+}
+
+// Scrolls to the last element that starts at or before the source line
+// eslint-disable-next-line no-unused-vars
+function scrollToLine(line) {
+  let target = null;
+  for (const el of contentEl.querySelectorAll("[data-line]")) {
+    const l = parseInt(el.dataset.line);
+    if (l > line) {
+      break;
+    }
+    if (target == null || l >= parseInt(target.dataset.line)) {
+      target = el;
+    }
+  }
+  if (target != null) {
+    target.scrollIntoView({ block: "center" });
+  }
+}
+
+// Scrolls to the element with the given id, or to the top if there is none
+function scrollToAnchor(id) {
+  const target = id === "" ? null : document.getElementById(id);
+  if (target != null) {
+    target.scrollIntoView();
+  } else {
+    window.scrollTo(0, 0);
+  }
+}
+
 // eslint-disable-next-line no-unused-vars
 function setContent(s) {
-  contentEl.innerHTML = s;
+  const pos = topVisibleLine();
+  const scrollY = window.scrollY;
+  updateContent(s);
+  restoreScroll(pos, scrollY);
+  updateTOC();
+  updateHeadings();
+  updateImages();
+  updateTasks();
+  updateCodeBlocks();
+  renderDiagrams();
+  renderMath();
+  updateSearch();
+  updateSource();
   const changed = document.querySelector(".changed");
   if (changed != null) {
     if (!isElementInView(changed)) {
@@ -31,9 +759,14 @@ document.documentElement.addEventListener(
     while (parent !== null && parent.tagName !== "A") {
       parent = parent.parentNode;
     }
-    if (parent != null) {
+    if (parent != null && parent.hasAttribute("href")) {
       event.preventDefault();
-      openURL(parent.getAttribute("href"));
+      const href = parent.getAttribute("href");
+      if (href.startsWith("#")) {
+        scrollToAnchor(href.slice(1));
+      } else {
+        openURL(href);
+      }
     }
   },
   false,
@@ -42,13 +775,113 @@ document.documentElement.addEventListener(
 document.addEventListener(
   "keydown",
   (ev) => {
+    if (ev.key === "f" && (ev.metaKey || ev.ctrlKey)) {
+      ev.preventDefault();
+      openSearch();
+      return;
+    }
+    if (ev.key === "p" && (ev.metaKey || ev.ctrlKey)) {
+      ev.preventDefault();
+      window.print();
+      return;
+    }
+    if ((ev.key === "=" || ev.key === "+") && (ev.metaKey || ev.ctrlKey)) {
+      ev.preventDefault();
+      changeFontSize(1);
+      return;
+    }
+    if (ev.key === "-" && (ev.metaKey || ev.ctrlKey)) {
+      ev.preventDefault();
+      changeFontSize(-1);
+      return;
+    }
+    if (ev.key === "w" && (ev.metaKey || ev.ctrlKey)) {
+      ev.preventDefault();
+      closeTab(currentTab);
+      return;
+    }
+    if (ev.key === "Tab" && ev.ctrlKey) {
+      ev.preventDefault();
+      nextTab(ev.shiftKey ? -1 : 1);
+      return;
+    }
+    if (ev.key === "u" && (ev.metaKey || ev.ctrlKey)) {
+      ev.preventDefault();
+      toggleSource();
+      return;
+    }
+    if (ev.key === "r" && (ev.metaKey || ev.ctrlKey)) {
+      ev.preventDefault();
+      reload();
+      return;
+    }
+    // Don't trigger single key shortcuts while typing
+    if (ev.target.tagName === "INPUT") {
+      return;
+    }
     if (ev.key === "q") {
       ev.preventDefault();
       quit();
       return;
     }
+    if (ev.key === "t") {
+      ev.preventDefault();
+      toggleTOC();
+      return;
+    }
+    if (ev.key === "T") {
+      ev.preventDefault();
+      nextTheme();
+      return;
+    }
+    if (
+      (ev.key === "n" || ev.key === "]" || ev.key === "p" || ev.key === "[") &&
+      !(ev.metaKey || ev.ctrlKey || ev.altKey)
+    ) {
+      ev.preventDefault();
+      scrollToHeading(ev.key === "n" || ev.key === "]" ? 1 : -1);
+      return;
+    }
+    if (ev.key === "Backspace" || (ev.key === "ArrowLeft" && ev.altKey)) {
+      ev.preventDefault();
+      back();
+      return;
+    }
   },
   false,
 );
 
+// Catches changes the file watcher missed
+if (document.body.dataset.reloadOnFocus === "true") {
+  window.addEventListener("focus", () => {
+    reload();
+  });
+}
+
+// The webview has no way to position the window, so ask the page to move it.
+// Not all platforms allow this.
+const windowX = parseInt(document.body.dataset.x);
+const windowY = parseInt(document.body.dataset.y);
+if (windowX >= 0 || windowY >= 0) {
+  window.moveTo(
+    windowX >= 0 ? windowX : window.screenX,
+    windowY >= 0 ? windowY : window.screenY,
+  );
+}
+
+// Report the window size so it can be restored on the next run. Sizes that
+// don't fit on the screen are not remembered.
+let resizeTimer = null;
+window.addEventListener("resize", () => {
+  clearTimeout(resizeTimer);
+  resizeTimer = setTimeout(() => {
+    if (
+      window.innerWidth <= screen.availWidth &&
+      window.innerHeight <= screen.availHeight
+    ) {
+      setGeometry(window.innerWidth, window.innerHeight);
+    }
+  }, 500);
+});
+
 onReady();
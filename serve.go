@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/pkg/browser"
+)
+
+//go:embed serve.js
+var serveScript string
+
+// Serves a document over HTTP, pushing updates to browsers with server-sent
+// events.
+type Server struct {
+	doc  *Document
+	opts Options
+
+	mu      sync.Mutex
+	last    []byte // Last rendered event
+	clients map[chan []byte]bool
+	cancel  context.CancelFunc // Cancels the update in progress
+}
+
+func NewServer(source string, opts Options) (*Server, error) {
+	doc, err := NewDocument(source, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &Server{doc: doc, opts: opts, clients: map[chan []byte]bool{}}, nil
+}
+
+func (s *Server) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		s.doc.Close()
+		return err
+	}
+	return s.Serve(l)
+}
+
+func (s *Server) Serve(l net.Listener) error {
+	defer s.doc.Close()
+	go s.doc.Watch(s.update)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", s.handleIndex)
+	mux.HandleFunc("/events", s.handleEvents)
+	mux.HandleFunc("/reload", s.handleReload)
+	mux.HandleFunc("/task", s.handleTask)
+	mux.HandleFunc("/source", s.handleSource)
+	infof("serving %s on %s", s.doc.source, l.Addr())
+	return http.Serve(l, mux)
+}
+
+// Serves a document on a free local port, and opens it in the default
+// browser. Used when no window can be opened.
+func serveInBrowser(source string, opts Options) error {
+	server, err := NewServer(source, opts)
+	if err != nil {
+		return err
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		server.doc.Close()
+		return err
+	}
+	url := fmt.Sprintf("http://%s/", l.Addr())
+	if err := browser.OpenURL(url); err != nil {
+		log.Printf("error opening browser (open %s manually): %v", url, err)
+	}
+	return server.Serve(l)
+}
+
+// Renders the document, and sends the result to all connected clients.
+// Starting a new update cancels the one in progress.
+func (s *Server) update() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s.mu.Lock()
+	if s.cancel != nil {
+		s.cancel()
+	}
+	s.cancel = cancel
+	s.mu.Unlock()
+
+	msg, err := s.render(ctx)
+	if ctx.Err() != nil {
+		return
+	} else if err != nil {
+		infof("render error: %v", err)
+		if msg, err = json.Marshal(struct {
+			Error string `json:"error"`
+		}{Error: err.Error()}); err != nil {
+			return
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if ctx.Err() != nil {
+		return
+	}
+	s.last = msg
+	for ch := range s.clients {
+		// Only the latest update matters to slow clients
+		select {
+		case <-ch:
+		default:
+		}
+		ch <- msg
+	}
+}
+
+func (s *Server) render(ctx context.Context) ([]byte, error) {
+	content, title, err := s.doc.Render(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(struct {
+		Title   string `json:"title"`
+		Content string `json:"content"`
+		Style   string `json:"style"`
+		Words   int    `json:"words"`
+		Path    string `json:"path"`
+		Time    int64  `json:"time"`
+	}{Title: windowTitle(s.opts, s.doc.title, title), Content: content, Style: s.doc.Style(), Words: s.doc.Words(), Path: s.doc.Path(), Time: time.Now().UnixMilli()})
+}
+
+func (s *Server) handleIndex(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	html, err := viewerHTML(s.opts, serveScript)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(html)
+}
+
+func (s *Server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	ch := make(chan []byte, 1)
+	s.mu.Lock()
+	s.clients[ch] = true
+	last := s.last
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.clients, ch)
+		s.mu.Unlock()
+	}()
+
+	if last == nil {
+		var err error
+		if last, err = s.render(r.Context()); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	msg := last
+	for {
+		fmt.Fprintf(w, "data: %s\n\n", msg)
+		flusher.Flush()
+		select {
+		case <-r.Context().Done():
+			return
+		case msg = <-ch:
+		}
+	}
+}
+
+// Returns whether a request comes from the viewer page, and not from another
+// site the browser has open. Requests without Origin don't come from a
+// browser page.
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && u.Host == r.Host
+}
+
+func (s *Server) handleReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !sameOrigin(r) {
+		http.Error(w, "cross-origin request", http.StatusForbidden)
+		return
+	}
+	s.update()
+}
+
+func (s *Server) handleSource(w http.ResponseWriter, r *http.Request) {
+	source, err := s.doc.Source()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	io.WriteString(w, source)
+}
+
+func (s *Server) handleTask(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.opts.Edit {
+		http.Error(w, "editing is disabled", http.StatusForbidden)
+		return
+	}
+	if !sameOrigin(r) {
+		http.Error(w, "cross-origin request", http.StatusForbidden)
+		return
+	}
+	// Other sites can only send JSON after a CORS preflight, which is never
+	// allowed, unlike forms and text/plain bodies
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != "application/json" {
+		http.Error(w, "expected JSON", http.StatusUnsupportedMediaType)
+		return
+	}
+	var req struct {
+		Index   int  `json:"index"`
+		Checked bool `json:"checked"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := s.doc.SetTask(req.Index, req.Checked); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
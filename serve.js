@@ -0,0 +1,74 @@
+// Stand-ins for the webview bindings when served over HTTP
+
+// eslint-disable-next-line no-unused-vars
+function onReady() {
+  const events = new EventSource("/events");
+  events.addEventListener("message", (event) => {
+    const msg = JSON.parse(event.data);
+    // eslint-disable-next-line no-undef
+    setError(msg.error || "");
+    if (msg.error) {
+      return;
+    }
+    document.title = msg.title;
+    // eslint-disable-next-line no-undef
+    setStyle(msg.style);
+    // eslint-disable-next-line no-undef
+    setWordCount(msg.words);
+    // eslint-disable-next-line no-undef
+    setContent(msg.content);
+    // eslint-disable-next-line no-undef
+    setStatus(msg.path, msg.time);
+  });
+}
+
+// eslint-disable-next-line no-unused-vars
+function openURL(url) {
+  window.open(url, "_blank", "noopener");
+}
+
+// eslint-disable-next-line no-unused-vars
+function quit() {}
+
+// eslint-disable-next-line no-unused-vars
+function back() {}
+
+// Local images aren't served
+// eslint-disable-next-line no-unused-vars
+function loadImage(src) {
+  return Promise.resolve(src);
+}
+
+// eslint-disable-next-line no-unused-vars
+function selectTab() {}
+
+// eslint-disable-next-line no-unused-vars
+function closeTab() {}
+
+// eslint-disable-next-line no-unused-vars
+function reload() {
+  return fetch("/reload", { method: "POST" });
+}
+
+// eslint-disable-next-line no-unused-vars
+function getSource() {
+  return fetch("/source").then((response) => response.text());
+}
+
+// eslint-disable-next-line no-unused-vars
+function setGeometry() {}
+
+// eslint-disable-next-line no-unused-vars
+function setFontSize() {}
+
+// eslint-disable-next-line no-unused-vars
+function saveTheme() {}
+
+// eslint-disable-next-line no-unused-vars
+function setTask(index, checked) {
+  return fetch("/task", {
+    method: "POST",
+    headers: { "Content-Type": "application/json" },
+    body: JSON.stringify({ index, checked }),
+  });
+}